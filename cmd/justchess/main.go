@@ -1,17 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"justchess/internal/auth"
 	"justchess/internal/db"
+	"justchess/internal/game"
 	"justchess/internal/security"
 	"justchess/internal/web"
 	"justchess/internal/ws"
 )
 
+const (
+	// Time to wait for pending HTTP requests on shutdown.
+	shutdownTimeout = 10 * time.Second
+	// Used if the SPECTATOR_DELAY environment variable isn't a valid duration.
+	defaultSpectatorDelay = 5 * time.Second
+	// Used if the ENGINE_PROCESSES environment variable isn't a valid number.
+	defaultEngineProcesses = 4
+)
+
 func main() {
 	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
 
@@ -39,15 +55,72 @@ func main() {
 		log.Panic(err)
 	}
 
-	wsService := ws.NewService(gr, pr)
-	go wsService.ListenEvents()
+	// Engine games are optional, thus the server starts without the engine.
+	// Each process serves one engine game at a time.
+	processes, err := strconv.Atoi(os.Getenv("ENGINE_PROCESSES"))
+	if err != nil || processes < 1 {
+		processes = defaultEngineProcesses
+	}
+	var engine game.Engine
+	if path := os.Getenv("ENGINE_PATH"); len(path) == 0 {
+		log.Print("ENGINE_PATH isn't set, engine games are disabled.")
+	} else if e, err := game.StartEnginePool(processes, path); err != nil {
+		log.Printf("Cannot start engine, engine games are disabled: %s", err)
+	} else {
+		log.Printf("%d engine processes started.", processes)
+		engine = e
+		defer e.Close()
+	}
+
+	// Stop the services on SIGINT and SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Spectators receive moves with a delay to prevent cheating.
+	delay, err := time.ParseDuration(os.Getenv("SPECTATOR_DELAY"))
+	if err != nil {
+		delay = defaultSpectatorDelay
+	}
+	wsService := ws.NewService(gr, pr, engine).WithSpectators(ws.SpectatorConfig{
+		Delay:           delay,
+		IsChatSeparated: os.Getenv("SPECTATOR_CHAT") == "separate",
+	})
+	wsStopped := make(chan struct{})
+	go func() {
+		wsService.ListenEvents(ctx)
+		close(wsStopped)
+	}()
+	go wsService.AdjudicateCorrespondence(ctx)
+	go game.DecayDeviations(ctx, pr)
 
 	// Register routes.
 	mux := http.NewServeMux()
 	wsService.RegisterRoutes(authService, mux)
-	webService.RegisterRoutes(mux)
+	webService.RegisterRoutes(authService, mux)
 	authService.RegisterRoutes(mux)
 
-	log.Print("Starting server.")
-	log.Panic(http.ListenAndServeTLS(":443", "cert.pem", "key.pem", security.Headers(mux)))
+	srv := &http.Server{Addr: ":443", Handler: security.Headers(mux)}
+	go func() {
+		log.Print("Starting server.")
+		err := srv.ListenAndServeTLS("cert.pem", "key.pem")
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Print(err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Print("Shutting down...")
+
+	// Wait until rooms checkpoint their games.  Handshakes are refused
+	// meanwhile, since the service is already closed.
+	<-wsStopped
+	log.Printf("Delivery to slow clients: %+v", wsService.DeliveryStats())
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(sctx); err != nil {
+		log.Print(err)
+	}
+	log.Print("Server stopped.")
 }
@@ -0,0 +1,93 @@
+// Command recompute replays all terminated rated games in the order of
+// completion and recomputes the ratings of the players with the specified
+// parameters.  The differences are printed and stored unless -dry-run is set.
+//
+// The server must be stopped before the ratings are stored, since the ratings
+// of the games completed meanwhile would be overwritten.  Storing fails if such
+// games are found.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"justchess/internal/db"
+	"justchess/internal/game"
+)
+
+func main() {
+	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
+
+	rp := game.DefaultRatingParams
+	isDryRun := flag.Bool("dry-run", false, "print the differences without storing them")
+	flag.Float64Var(&rp.MinRating, "min-rating", rp.MinRating, "minimal rating")
+	flag.Float64Var(&rp.MaxRating, "max-rating", rp.MaxRating, "maximal rating")
+	flag.Float64Var(&rp.MinDeviation, "min-deviation", rp.MinDeviation, "minimal rating deviation")
+	flag.Float64Var(&rp.MinSigma, "min-sigma", rp.MinSigma, "minimal rating volatility")
+	flag.Float64Var(&rp.MaxSigma, "max-sigma", rp.MaxSigma, "maximal rating volatility")
+	flag.Float64Var(&rp.Tau, "tau", rp.Tau, "Glicko-2 system constant")
+	flag.Parse()
+
+	pool, err := db.OpenDB(os.Getenv("DB_DSN"))
+	if err != nil {
+		log.Panic(err)
+	}
+	defer pool.Close()
+
+	pr := db.NewSQLPlayerRepo(pool)
+	gr := db.NewSQLGameRepo(pool)
+
+	results, err := gr.SelectRatedResults()
+	if err != nil {
+		log.Panic(err)
+	}
+	old, err := pr.SelectRatings()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	games, ratings := game.Recompute(results, rp, time.Now())
+	printDiff(old, ratings)
+	log.Printf("Replayed %d games, recomputed %d ratings.", len(games), len(ratings))
+
+	if *isDryRun {
+		return
+	}
+	if err = pr.ReplaceRatings(games, ratings); err != nil {
+		log.Panic(err)
+	}
+	log.Print("Ratings are stored.")
+}
+
+// printDiff prints the old and the new rating of each player in each category.
+func printDiff(old, recomputed []db.CategoryRating) {
+	type key struct {
+		id string
+		c  db.Category
+	}
+	prev := make(map[key]db.CategoryRating, len(old))
+	for _, r := range old {
+		prev[key{r.Id, r.Category}] = r
+	}
+
+	for _, r := range recomputed {
+		k := key{r.Id, r.Category}
+		o, exists := prev[k]
+		delete(prev, k)
+		if !exists {
+			fmt.Printf("%s %s: none -> %.0f±%.0f\n", r.Id, r.Category,
+				r.Rating, r.Deviation)
+			continue
+		}
+		fmt.Printf("%s %s: %.0f±%.0f -> %.0f±%.0f\n", r.Id, r.Category,
+			o.Rating, o.Deviation, r.Rating, r.Deviation)
+	}
+	// Ratings without terminated games are removed.
+	for _, o := range prev {
+		fmt.Printf("%s %s: %.0f±%.0f -> none\n", o.Id, o.Category,
+			o.Rating, o.Deviation)
+	}
+}
@@ -2,27 +2,157 @@ package db
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"log"
 	"time"
 
+	"justchess/internal/position"
+
 	"github.com/treepeck/chego"
 )
 
-// RatedGame represents the state of a single rated game.
+// ControlType represents the way the time bonus is applied after each move.
+type ControlType int
+
+const (
+	// Fischer adds the bonus to the player's clock after each move.
+	Fischer ControlType = iota
+	// Delay (also known as US delay) doesn't run the player's clock until the
+	// bonus expires on each move.  Unused bonus is lost.
+	Delay
+	// Bronstein adds the time spent on the move back to the player's clock,
+	// but no more than the bonus.
+	Bronstein
+)
+
+// Stage adds Time seconds to the player's clock right after the player completes
+// the Move-th move.  Used for multi-stage time controls, e.g. 40/90+30 is the 90
+// minutes control with a single stage {40, 1800} and 30 seconds bonus.
+type Stage struct {
+	Move int `json:"m"`
+	Time int `json:"t"`
+}
+
+// Stages implements [sql.Scanner] and [driver.Valuer] to be stored as a single
+// JSON column.
+type Stages []Stage
+
+func (s Stages) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(s)
+}
+
+func (s *Stages) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return errors.New("db: unsupported type of time stages")
+}
+
+// TimeControl describes the clock settings of a single game.  Control and Bonus
+// are specified in seconds.
+type TimeControl struct {
+	Stages  Stages
+	Control int
+	Bonus   int
+	Type    ControlType
+}
+
+// Category groups time controls by the estimated game duration.  Players have a
+// separate rating in each category.
+type Category int
+
+const (
+	Bullet Category = iota
+	Blitz
+	Rapid
+	Classical
+)
+
+// Categories lists all rating categories in ascending order of duration.
+var Categories = [...]Category{Bullet, Blitz, Rapid, Classical}
+
+func (c Category) String() string {
+	switch c {
+	case Bullet:
+		return "bullet"
+	case Blitz:
+		return "blitz"
+	case Rapid:
+		return "rapid"
+	default:
+		return "classical"
+	}
+}
+
+// ParseCategory returns the category with the specified name.
+func ParseCategory(name string) (Category, bool) {
+	for _, c := range Categories {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return Bullet, false
+}
+
+// Category returns the rating category of the time control.  The game duration
+// is estimated for 40 moves by each player:
+//   - Bullet: less than 3 minutes;
+//   - Blitz: less than 8 minutes;
+//   - Rapid: less than 25 minutes;
+//   - Classical: otherwise.
+func (tc TimeControl) Category() Category {
+	duration := tc.Control + 40*tc.Bonus
+	for _, s := range tc.Stages {
+		duration += s.Time
+	}
+
+	switch {
+	case duration < 180:
+		return Bullet
+	case duration < 480:
+		return Blitz
+	case duration < 1500:
+		return Rapid
+	default:
+		return Classical
+	}
+}
+
+// RatedGame represents the state of a single rated game.  Casual games are
+// represented the same way.
 type RatedGame struct {
-	White       Player
-	Black       Player
-	Moves       []chego.PlayedMove
-	TimeDiffs   []int
-	Id          string
+	CreatedAt time.Time
+	White     Player
+	Black     Player
+	Moves     []chego.PlayedMove
+	TimeDiffs []int
+	Stages    Stages
+	Id        string
+	// FEN of the starting position.  Empty for the standard one.
+	FEN         string
 	MovesLength int
 	Control     int
 	Bonus       int
+	ControlType ControlType
 	Result      chego.Result
 	Termination chego.Termination
+	// Rating changes of the players.  Zero for casual and unterminated games.
+	WhiteDelta float64
+	BlackDelta float64
 }
 
-// RatedGameBrief represents a brief rated game description to fill up
+// RatedGameBrief represents a brief rated or casual game description to fill up
 // the player profile page with game history.
 type RatedGameBrief struct {
 	CreatedAt   time.Time         `json:"c"`
@@ -36,9 +166,12 @@ type RatedGameBrief struct {
 	MovesLength int               `json:"m"`
 	Control     int               `json:"ctl"`
 	Bonus       int               `json:"bns"`
+	ControlType ControlType       `json:"ct"`
+	Stages      Stages            `json:"s,omitempty"`
+	IsCasual    bool              `json:"cs,omitempty"`
 }
 
-// RatedGameUpdate is used to update the rated game entity in database.
+// RatedGameUpdate is used to update the rated or casual game entity in database.
 type RatedGameUpdate struct {
 	EncodedMoves    []byte
 	CompressedDiffs []byte
@@ -46,6 +179,39 @@ type RatedGameUpdate struct {
 	Result          chego.Result
 	Termination     chego.Termination
 	MovesLength     int
+	// Rating changes of the players.  Ignored for casual games.
+	White RatingChange
+	Black RatingChange
+}
+
+// Rate estimates the ratings of the players after the game and records the
+// rating changes in the update.
+func (gu *RatedGameUpdate) Rate(white, black Player, rate RateFunc,
+) (RatingUpdate, RatingUpdate) {
+	wu, bu := rate(white, black)
+	gu.White = RatingChange{Rating: white.Rating, Delta: wu.Rating - white.Rating}
+	gu.Black = RatingChange{Rating: black.Rating, Delta: bu.Rating - black.Rating}
+	return wu, bu
+}
+
+// RatedResult is the result of the terminated rated game.
+type RatedResult struct {
+	CompletedAt time.Time
+	Id          string
+	WhiteId     string
+	BlackId     string
+	Control     TimeControl
+	Result      chego.Result
+}
+
+// RateFunc estimates the ratings of the players after the game.
+type RateFunc func(white, black Player) (RatingUpdate, RatingUpdate)
+
+// RatingChange describes how the player's rating has changed after the game.
+type RatingChange struct {
+	// Rating before the game.
+	Rating float64
+	Delta  float64
 }
 
 // EngineDifficulty represents the skill level of engine.
@@ -61,9 +227,12 @@ const (
 
 // EngineGame represents the state of a single game played vs engine.
 type EngineGame struct {
-	Player      Player
-	Moves       []chego.PlayedMove
-	Id          string
+	CreatedAt time.Time
+	Player    Player
+	Moves     []chego.PlayedMove
+	Id        string
+	// FEN of the starting position.  Empty for the standard one.
+	FEN         string
 	PlayerColor chego.Color
 	Result      chego.Result
 	Termination chego.Termination
@@ -92,6 +261,107 @@ type EngineGameUpdate struct {
 	MovesLength  int
 }
 
+// CorrespondenceGame represents the state of a single correspondence game.
+// Unlike other games, moves are decoded even if the game is not terminated.
+type CorrespondenceGame struct {
+	// Moment until which the active player must complete the move.
+	Deadline    time.Time
+	White       Player
+	Black       Player
+	Moves       []chego.PlayedMove
+	Encoded     []byte
+	Id          string
+	DaysPerMove int
+	MovesLength int
+	Result      chego.Result
+	Termination chego.Termination
+}
+
+// CorrespondenceGameUpdate is used to update the correspondence game entity in
+// database after each move.
+type CorrespondenceGameUpdate struct {
+	Deadline     time.Time
+	EncodedMoves []byte
+	Id           string
+	Result       chego.Result
+	Termination  chego.Termination
+	MovesLength  int
+	// Number of moves before the update.  The update is rejected if the stored
+	// game differs, which prevents overwriting concurrent moves.
+	PrevLength int
+}
+
+// ErrStaleGame is returned if the game has been modified concurrently.
+var ErrStaleGame = errors.New("db: game has been modified concurrently")
+
+// Header is the PGN tag pair of the imported game.
+type Header struct {
+	Name  string `json:"n"`
+	Value string `json:"v"`
+}
+
+// Headers implements [sql.Scanner] and [driver.Valuer] to be stored as a single
+// JSON column.
+type Headers []Header
+
+func (h Headers) Value() (driver.Value, error) {
+	return json.Marshal(h)
+}
+
+func (h *Headers) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, h)
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	}
+	return errors.New("db: unsupported type of game headers")
+}
+
+// ImportedGame represents the game imported by the player from PGN.  Players
+// are specified by their names in PGN, since they might not be registered.
+type ImportedGame struct {
+	CreatedAt   time.Time
+	Headers     Headers
+	Moves       []chego.PlayedMove
+	Encoded     []byte
+	Id          string
+	PlayerId    string
+	White       string
+	Black       string
+	Result      chego.Result
+	MovesLength int
+}
+
+// ImportedGameBrief represents a brief imported game description to fill up the
+// player profile page with game history.
+type ImportedGameBrief struct {
+	CreatedAt   time.Time    `json:"c"`
+	Id          string       `json:"i"`
+	White       string       `json:"w"`
+	Black       string       `json:"b"`
+	Result      chego.Result `json:"r"`
+	MovesLength int          `json:"m"`
+}
+
+// GameKind distinguishes the games stored in checkpoints.
+type GameKind int
+
+const (
+	RatedKind GameKind = iota
+	CasualKind
+	EngineKind
+)
+
+// Checkpoint is the serialized state of the unterminated live game.  Used to
+// restore games after the server restart.
+type Checkpoint struct {
+	UpdatedAt time.Time
+	State     []byte
+	Id        string
+	Kind      GameKind
+}
+
 // Pagination is used to skip certain amount of game records without use of slow
 // OFFSET SQL statement. Can be used for all kinds of games.
 type Pagination struct {
@@ -102,19 +372,64 @@ type Pagination struct {
 // GameRepo provides access to game data.
 // SelectOlder* is same as SelectNewest* but applies pagination.
 type GameRepo interface {
-	InsertRated(id, whiteId, blackId string, control, bonus int) error
+	// InsertRated, InsertCasual and InsertEngine store the FEN of the starting
+	// position, which is empty for the standard one.  Moves of the games are
+	// decoded from that position.
+	InsertRated(id, whiteId, blackId string, tc TimeControl, fen string) error
 	SelectRated(id string) (RatedGame, error)
 	SelectNewestRated(id string) ([]RatedGameBrief, error)
 	SelectOlderRated(id string, p Pagination) ([]RatedGameBrief, error)
-	UpdateRated(gu RatedGameUpdate) error
+	// FinalizeRated stores the terminated rated game and updates the ratings of
+	// its players in the category atomically.  The current ratings of the
+	// players are locked and passed to rate, which estimates the ratings after
+	// the game.  Returns [ErrStaleGame] and changes nothing if the game is
+	// already terminated, so repeated calls are safe.
+	FinalizeRated(gu RatedGameUpdate, c Category, whiteId, blackId string,
+		rate RateFunc) error
+	// SelectRatedResults selects results of all terminated rated games in the
+	// order of completion.  Abandoned games are skipped.
+	SelectRatedResults() ([]RatedResult, error)
 	MarkRatedAsAbandoned(id string) error
 
-	InsertEngine(id, playerId string, c chego.Color, d EngineDifficulty) error
+	InsertCasual(id, whiteId, blackId string, tc TimeControl, fen string) error
+	SelectCasual(id string) (RatedGame, error)
+	SelectNewestCasual(id string) ([]RatedGameBrief, error)
+	SelectOlderCasual(id string, p Pagination) ([]RatedGameBrief, error)
+	UpdateCasual(gu RatedGameUpdate) error
+	MarkCasualAsAbandoned(id string) error
+
+	InsertEngine(id, playerId string, c chego.Color, d EngineDifficulty,
+		fen string) error
 	SelectEngine(id string) (EngineGame, error)
 	SelectNewestEngine(id string) ([]EngineGameBrief, error)
 	SelectOlderEngine(id string, p Pagination) ([]EngineGameBrief, error)
 	UpdateEngine(gu EngineGameUpdate) error
 	MarkEngineAsAbandoned(id string) error
+
+	InsertCorrespondence(id, whiteId, blackId string, days int,
+		deadline time.Time) error
+	SelectCorrespondence(id string) (CorrespondenceGame, error)
+	// SelectExpiredCorrespondence selects ids of unterminated correspondence
+	// games with expired move deadline.
+	SelectExpiredCorrespondence() ([]string, error)
+	// UpdateCorrespondence returns [ErrStaleGame] if the game has been updated
+	// concurrently or is already terminated.
+	UpdateCorrespondence(gu CorrespondenceGameUpdate) error
+
+	// InsertImported stores the games imported by the player atomically.
+	InsertImported(games []ImportedGame) error
+	SelectImported(id string) (ImportedGame, error)
+	SelectNewestImported(id string) ([]ImportedGameBrief, error)
+	SelectOlderImported(id string, p Pagination) ([]ImportedGameBrief, error)
+
+	// UpsertCheckpoint inserts the checkpoint or replaces the existing one with
+	// the same id.
+	UpsertCheckpoint(c Checkpoint) error
+	SelectCheckpoints() ([]Checkpoint, error)
+	DeleteCheckpoint(id string) error
+	// SelectTermination selects the stored termination of the checkpointed
+	// game.  The checkpoint is outdated if the game is already terminated.
+	SelectTermination(c Checkpoint) (chego.Termination, error)
 }
 
 // SQLGameRepo wraps the SQL database handle and implements [GameRepo].
@@ -124,102 +439,178 @@ type SQLGameRepo struct {
 
 func NewSQLGameRepo(p *sql.DB) SQLGameRepo { return SQLGameRepo{pool: p} }
 
-func (r SQLGameRepo) InsertRated(id, whiteId, blackId string, control, bonus int) error {
-	_, err := r.pool.Exec(insertRated, id, whiteId, blackId, control, bonus)
+func (r SQLGameRepo) InsertRated(id, whiteId, blackId string, tc TimeControl,
+	fen string,
+) error {
+	_, err := r.pool.Exec(
+		insertRated, id, whiteId, blackId, tc.Control, tc.Bonus, tc.Type, tc.Stages,
+		fen,
+	)
 	return err
 }
 
 func (r SQLGameRepo) SelectRated(id string) (RatedGame, error) {
-	row := r.pool.QueryRow(selectRated, id)
+	return scanRated(r.pool.QueryRow(selectRated, id))
+}
 
-	var g RatedGame
-	var encoded, compressed []byte
-	if err := row.Scan(
-		// Scan white player.
-		&g.White.Id, &g.White.Name, &g.White.Rating,
-		&g.White.Deviation, &g.White.Volatility,
-		// Scan black player.
-		&g.Black.Id, &g.Black.Name, &g.Black.Rating,
-		&g.Black.Deviation, &g.Black.Volatility,
-		// Scan game data.
-		&g.Id, &g.Control, &g.Bonus, &g.Result, &g.MovesLength,
-		&encoded, &g.Termination, &compressed,
+func (r SQLGameRepo) SelectNewestRated(id string) ([]RatedGameBrief, error) {
+	rows, err := r.pool.Query(selectNewestRated, id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRatedBriefs(rows, false)
+}
+
+func (r SQLGameRepo) SelectOlderRated(id string, p Pagination) ([]RatedGameBrief, error) {
+	rows, err := r.pool.Query(
+		selectOlderRated, id, id, p.CursorCreatedAt,
+		p.CursorId, p.CursorCreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRatedBriefs(rows, false)
+}
+
+func (r SQLGameRepo) FinalizeRated(gu RatedGameUpdate, c Category,
+	whiteId, blackId string, rate RateFunc,
+) error {
+	tx, err := r.pool.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback has no effect after the commit.
+	defer tx.Rollback()
+
+	// Players are locked in the same order by every transaction to avoid
+	// deadlocks.
+	ids := [2]string{whiteId, blackId}
+	if blackId < whiteId {
+		ids = [2]string{blackId, whiteId}
+	}
+	players := make(map[string]Player, 2)
+	for _, id := range ids {
+		var p Player
+		if err = tx.QueryRow(selectRatingForUpdate, c, id).Scan(
+			&p.Id, &p.Name, &p.Rating, &p.Deviation, &p.Volatility,
+		); err != nil {
+			return err
+		}
+		players[id] = p
+	}
+
+	wu, bu := gu.Rate(players[whiteId], players[blackId], rate)
+
+	// The game is finalized only once, thus repeated calls don't change the
+	// ratings twice.
+	res, err := tx.Exec(
+		updateRated, gu.Result, gu.Termination, gu.MovesLength,
+		gu.EncodedMoves, gu.CompressedDiffs,
+		gu.White.Rating, gu.White.Delta, gu.Black.Rating, gu.Black.Delta, gu.Id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrStaleGame
+	}
+
+	if _, err = tx.Exec(upsertRatings,
+		wu.Id, c, wu.Rating, wu.Deviation, wu.Volatility,
+		bu.Id, c, bu.Rating, bu.Deviation, bu.Volatility,
 	); err != nil {
-		return g, err
+		return err
 	}
 
-	// Decode moves and time diffs if the game has been terminated.
-	if g.Termination != chego.Unterminated {
-		g.Moves = chego.HuffmanDecoding(encoded, g.MovesLength)
-		g.TimeDiffs = chego.DecompressTimeDiffs(compressed, g.MovesLength)
+	if _, err = tx.Exec(insertRatingHistory,
+		wu.Id, gu.Id, c, wu.Rating,
+		bu.Id, gu.Id, c, bu.Rating,
+	); err != nil {
+		return err
 	}
-	return g, nil
+	return tx.Commit()
 }
 
-func (r SQLGameRepo) SelectNewestRated(id string) ([]RatedGameBrief, error) {
-	rows, err := r.pool.Query(selectNewestRated, id, id)
+func (r SQLGameRepo) SelectRatedResults() ([]RatedResult, error) {
+	rows, err := r.pool.Query(selectRatedResults)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	games := make([]RatedGameBrief, 0, 10)
+	results := make([]RatedResult, 0)
 	for rows.Next() {
-		var g RatedGameBrief
+		var rr RatedResult
 		if err = rows.Scan(
-			&g.WhiteName, &g.BlackName, &g.Result, &g.Termination,
-			&g.Control, &g.Bonus, &g.MovesLength, &g.CreatedAt, &g.Id,
-			&g.WhiteId, &g.BlackId,
+			&rr.Id, &rr.WhiteId, &rr.BlackId, &rr.Control.Control,
+			&rr.Control.Bonus, &rr.Control.Type, &rr.Control.Stages,
+			&rr.Result, &rr.CompletedAt,
 		); err != nil {
 			return nil, err
 		}
-		games = append(games, g)
+		results = append(results, rr)
 	}
-	return games, err
+	return results, rows.Err()
 }
 
-func (r SQLGameRepo) SelectOlderRated(id string, p Pagination) ([]RatedGameBrief, error) {
-	rows, err := r.pool.Query(
-		selectOlderRated, id, id, p.CursorCreatedAt,
-		p.CursorId, p.CursorCreatedAt,
+func (r SQLGameRepo) MarkRatedAsAbandoned(id string) error {
+	_, err := r.pool.Exec(markRatedAsAbandoned, id)
+	return err
+}
+
+func (r SQLGameRepo) InsertCasual(id, whiteId, blackId string, tc TimeControl,
+	fen string,
+) error {
+	_, err := r.pool.Exec(
+		insertCasual, id, whiteId, blackId, tc.Control, tc.Bonus, tc.Type, tc.Stages,
+		fen,
 	)
+	return err
+}
+
+func (r SQLGameRepo) SelectCasual(id string) (RatedGame, error) {
+	return scanRated(r.pool.QueryRow(selectCasual, id))
+}
+
+func (r SQLGameRepo) SelectNewestCasual(id string) ([]RatedGameBrief, error) {
+	rows, err := r.pool.Query(selectNewestCasual, id, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanRatedBriefs(rows, true)
+}
 
-	games := make([]RatedGameBrief, 0, 10)
-	for rows.Next() {
-		var g RatedGameBrief
-		if err = rows.Scan(
-			&g.WhiteName, &g.BlackName, &g.Result, &g.Termination,
-			&g.Control, &g.Bonus, &g.MovesLength, &g.CreatedAt, &g.Id,
-			&g.WhiteId, &g.BlackId,
-		); err != nil {
-			log.Print(err)
-			return nil, err
-		}
-		games = append(games, g)
+func (r SQLGameRepo) SelectOlderCasual(id string, p Pagination) ([]RatedGameBrief, error) {
+	rows, err := r.pool.Query(
+		selectOlderCasual, id, id, p.CursorCreatedAt,
+		p.CursorId, p.CursorCreatedAt,
+	)
+	if err != nil {
+		return nil, err
 	}
-	return games, err
+	defer rows.Close()
+	return scanRatedBriefs(rows, true)
 }
 
-func (r SQLGameRepo) UpdateRated(gu RatedGameUpdate) error {
+func (r SQLGameRepo) UpdateCasual(gu RatedGameUpdate) error {
 	_, err := r.pool.Exec(
-		updateRated, gu.Result, gu.Termination, gu.MovesLength,
+		updateCasual, gu.Result, gu.Termination, gu.MovesLength,
 		gu.EncodedMoves, gu.CompressedDiffs, gu.Id,
 	)
 	return err
 }
 
-func (r SQLGameRepo) MarkRatedAsAbandoned(id string) error {
-	_, err := r.pool.Exec(markRatedAsAbandoned, id)
+func (r SQLGameRepo) MarkCasualAsAbandoned(id string) error {
+	_, err := r.pool.Exec(markCasualAsAbandoned, id)
 	return err
 }
 
 func (r SQLGameRepo) InsertEngine(id, playerId string, c chego.Color,
-	d EngineDifficulty) error {
-	_, err := r.pool.Exec(insertEngine, id, playerId, c, d)
+	d EngineDifficulty, fen string) error {
+	_, err := r.pool.Exec(insertEngine, id, playerId, c, d, fen)
 	return err
 }
 
@@ -232,7 +623,7 @@ func (r SQLGameRepo) SelectEngine(id string) (EngineGame, error) {
 		&g.Player.Id, &g.Player.Name, &g.Player.Rating,
 		&g.Player.Deviation, &g.Player.Volatility,
 		&g.Id, &g.Result, &g.Termination, &g.MovesLength,
-		&encoded, &g.PlayerColor, &g.Difficulty,
+		&encoded, &g.PlayerColor, &g.Difficulty, &g.CreatedAt, &g.FEN,
 	)
 	if err != nil {
 		return g, err
@@ -240,7 +631,7 @@ func (r SQLGameRepo) SelectEngine(id string) (EngineGame, error) {
 
 	// Decode moves if the game has been terminated.
 	if g.Termination != chego.Unterminated {
-		g.Moves = chego.HuffmanDecoding(encoded, g.MovesLength)
+		g.Moves = position.Decode(g.FEN, encoded, g.MovesLength)
 	}
 	return g, nil
 }
@@ -300,6 +691,220 @@ func (r SQLGameRepo) MarkEngineAsAbandoned(id string) error {
 	return err
 }
 
+func (r SQLGameRepo) InsertCorrespondence(id, whiteId, blackId string, days int,
+	deadline time.Time,
+) error {
+	_, err := r.pool.Exec(insertCorrespondence, id, whiteId, blackId, days, deadline)
+	return err
+}
+
+func (r SQLGameRepo) SelectCorrespondence(id string) (CorrespondenceGame, error) {
+	row := r.pool.QueryRow(selectCorrespondence, id)
+
+	var g CorrespondenceGame
+	if err := row.Scan(
+		&g.White.Id, &g.White.Name, &g.White.Rating,
+		&g.White.Deviation, &g.White.Volatility,
+		&g.Black.Id, &g.Black.Name, &g.Black.Rating,
+		&g.Black.Deviation, &g.Black.Volatility,
+		&g.Id, &g.DaysPerMove, &g.Deadline, &g.Result,
+		&g.MovesLength, &g.Encoded, &g.Termination,
+	); err != nil {
+		return g, err
+	}
+
+	g.Moves = chego.HuffmanDecoding(g.Encoded, g.MovesLength)
+	return g, nil
+}
+
+func (r SQLGameRepo) SelectExpiredCorrespondence() ([]string, error) {
+	rows, err := r.pool.Query(
+		selectExpiredCorrespondence, chego.Unterminated, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0, 10)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r SQLGameRepo) UpdateCorrespondence(gu CorrespondenceGameUpdate) error {
+	res, err := r.pool.Exec(
+		updateCorrespondence, gu.Result, gu.Termination, gu.MovesLength,
+		gu.EncodedMoves, gu.Deadline, gu.Id, gu.PrevLength, chego.Unterminated,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrStaleGame
+	}
+	return nil
+}
+
+func (r SQLGameRepo) InsertImported(games []ImportedGame) error {
+	tx, err := r.pool.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback has no effect after the commit.
+	defer tx.Rollback()
+
+	for _, g := range games {
+		if _, err = tx.Exec(
+			insertImported, g.Id, g.PlayerId, g.White, g.Black,
+			g.Result, g.MovesLength, g.Encoded, g.Headers,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r SQLGameRepo) SelectImported(id string) (ImportedGame, error) {
+	row := r.pool.QueryRow(selectImported, id)
+
+	var g ImportedGame
+	if err := row.Scan(
+		&g.Id, &g.PlayerId, &g.White, &g.Black, &g.Result,
+		&g.MovesLength, &g.Encoded, &g.Headers, &g.CreatedAt,
+	); err != nil {
+		return g, err
+	}
+
+	g.Moves = chego.HuffmanDecoding(g.Encoded, g.MovesLength)
+	return g, nil
+}
+
+func (r SQLGameRepo) SelectNewestImported(id string) ([]ImportedGameBrief, error) {
+	rows, err := r.pool.Query(selectNewestImported, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanImportedBriefs(rows)
+}
+
+func (r SQLGameRepo) SelectOlderImported(id string, p Pagination) ([]ImportedGameBrief, error) {
+	rows, err := r.pool.Query(
+		selectOlderImported, id, p.CursorCreatedAt, p.CursorId, p.CursorCreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanImportedBriefs(rows)
+}
+
+func (r SQLGameRepo) UpsertCheckpoint(c Checkpoint) error {
+	_, err := r.pool.Exec(upsertCheckpoint, c.Id, c.Kind, c.State)
+	return err
+}
+
+func (r SQLGameRepo) SelectCheckpoints() ([]Checkpoint, error) {
+	rows, err := r.pool.Query(selectCheckpoints)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := make([]Checkpoint, 0, 10)
+	for rows.Next() {
+		var c Checkpoint
+		if err = rows.Scan(&c.Id, &c.Kind, &c.State, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	return checkpoints, rows.Err()
+}
+
+func (r SQLGameRepo) DeleteCheckpoint(id string) error {
+	_, err := r.pool.Exec(deleteCheckpoint, id)
+	return err
+}
+
+func (r SQLGameRepo) SelectTermination(c Checkpoint) (chego.Termination, error) {
+	query := selectRatedTermination
+	switch c.Kind {
+	case CasualKind:
+		query = selectCasualTermination
+	case EngineKind:
+		query = selectEngineTermination
+	}
+	var t chego.Termination
+	return t, r.pool.QueryRow(query, c.Id).Scan(&t)
+}
+
+// scanRated scans a single rated or casual game.
+func scanRated(row *sql.Row) (RatedGame, error) {
+	var g RatedGame
+	var encoded, compressed []byte
+	if err := row.Scan(
+		// Scan white player.
+		&g.White.Id, &g.White.Name, &g.White.Rating,
+		&g.White.Deviation, &g.White.Volatility,
+		// Scan black player.
+		&g.Black.Id, &g.Black.Name, &g.Black.Rating,
+		&g.Black.Deviation, &g.Black.Volatility,
+		// Scan game data.
+		&g.Id, &g.Control, &g.Bonus, &g.ControlType, &g.Stages,
+		&g.Result, &g.MovesLength, &encoded, &g.Termination, &compressed,
+		&g.WhiteDelta, &g.BlackDelta, &g.CreatedAt, &g.FEN,
+	); err != nil {
+		return g, err
+	}
+
+	// Decode moves and time diffs if the game has been terminated.
+	if g.Termination != chego.Unterminated {
+		g.Moves = position.Decode(g.FEN, encoded, g.MovesLength)
+		g.TimeDiffs = chego.DecompressTimeDiffs(compressed, g.MovesLength)
+	}
+	return g, nil
+}
+
+// scanRatedBriefs scans rated or casual game briefs.
+func scanRatedBriefs(rows *sql.Rows, isCasual bool) ([]RatedGameBrief, error) {
+	games := make([]RatedGameBrief, 0, 10)
+	for rows.Next() {
+		g := RatedGameBrief{IsCasual: isCasual}
+		if err := rows.Scan(
+			&g.WhiteName, &g.BlackName, &g.Result, &g.Termination,
+			&g.Control, &g.Bonus, &g.ControlType, &g.Stages,
+			&g.MovesLength, &g.CreatedAt, &g.Id, &g.WhiteId, &g.BlackId,
+		); err != nil {
+			log.Print(err)
+			return nil, err
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+// scanImportedBriefs scans imported game briefs.
+func scanImportedBriefs(rows *sql.Rows) ([]ImportedGameBrief, error) {
+	games := make([]ImportedGameBrief, 0, 10)
+	for rows.Next() {
+		var g ImportedGameBrief
+		if err := rows.Scan(
+			&g.Id, &g.White, &g.Black, &g.Result, &g.MovesLength, &g.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
 const (
 	insertRated = `
 	INSERT INTO rated_game (
@@ -307,32 +912,41 @@ const (
 		white_id,
 		black_id,
 		time_control,
-		time_bonus
+		time_bonus,
+		control_type,
+		time_stages,
+		fen
 	)
-	VALUES (?, ?, ?, ?, ?)`
+	VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`
 
 	selectRated = `
 	SELECT
 		w.id AS w_id,
 		w.name AS w_name,
-		w.rating AS w_rating,
+		COALESCE(g.white_rating, w.rating) AS w_rating,
 		w.rating_deviation AS w_rating_deviation,
 		w.rating_volatility AS w_rating_volatility,
 
 		b.id AS b_id,
 		b.name AS b_name,
-		b.rating AS b_rating,
+		COALESCE(g.black_rating, b.rating) AS b_rating,
 		b.rating_deviation AS b_rating_deviation,
 		b.rating_volatility AS b_rating_volatility,
 
 		g.id,
 		g.time_control,
 		g.time_bonus,
+		g.control_type,
+		g.time_stages,
 		g.result,
 		g.moves_length,
 		g.moves,
 		g.termination,
-		g.time_differences
+		g.time_differences,
+		COALESCE(g.white_rating_delta, 0),
+		COALESCE(g.black_rating_delta, 0),
+		g.created_at,
+		COALESCE(g.fen, '')
 	FROM rated_game g
 	INNER JOIN player w ON g.white_id = w.id
 	INNER JOIN player b ON g.black_id = b.id
@@ -346,6 +960,8 @@ const (
 	    g.termination,
 	    g.time_control,
    	    g.time_bonus,
+	    g.control_type,
+	    g.time_stages,
 	    g.moves_length,
 	    g.created_at,
 	    g.id,
@@ -368,6 +984,8 @@ const (
 		g.termination,
 		g.time_control,
 		g.time_bonus,
+		g.control_type,
+		g.time_stages,
 		g.moves_length,
 		g.created_at,
 		g.id,
@@ -388,6 +1006,154 @@ const (
 
 	updateRated = `
 	UPDATE rated_game
+	SET
+		result = ?,
+		termination = ?,
+		moves_length = ?,
+		moves = ?,
+		time_differences = ?,
+		white_rating = ?,
+		white_rating_delta = ?,
+		black_rating = ?,
+		black_rating_delta = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND termination = 0`
+
+	// Terminated games are never abandoned.
+	markRatedAsAbandoned = `
+	UPDATE rated_game SET termination = 1 WHERE id = ? AND termination = 0`
+
+	// Skips unterminated and abandoned games.
+	selectRatedResults = `
+	SELECT
+		id,
+		white_id,
+		black_id,
+		time_control,
+		time_bonus,
+		control_type,
+		time_stages,
+		result,
+		updated_at
+	FROM rated_game
+	WHERE termination NOT IN (0, 1)
+	ORDER BY updated_at, id`
+
+	// Locks the player along with the rating in the category until the end of
+	// the transaction.
+	selectRatingForUpdate = `
+	SELECT
+		p.id,
+		p.name,
+		COALESCE(r.rating, p.rating),
+		COALESCE(r.rating_deviation, p.rating_deviation),
+		COALESCE(r.rating_volatility, p.rating_volatility)
+	FROM player p
+	LEFT JOIN player_rating r
+	ON r.player_id = p.id AND r.category = ?
+	WHERE p.id = ? AND p.is_guest = FALSE
+	FOR UPDATE`
+
+	insertCasual = `
+	INSERT INTO casual_game (
+		id,
+		white_id,
+		black_id,
+		time_control,
+		time_bonus,
+		control_type,
+		time_stages,
+		fen
+	)
+	VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`
+
+	selectCasual = `
+	SELECT
+		w.id AS w_id,
+		w.name AS w_name,
+		w.rating AS w_rating,
+		w.rating_deviation AS w_rating_deviation,
+		w.rating_volatility AS w_rating_volatility,
+
+		b.id AS b_id,
+		b.name AS b_name,
+		b.rating AS b_rating,
+		b.rating_deviation AS b_rating_deviation,
+		b.rating_volatility AS b_rating_volatility,
+
+		g.id,
+		g.time_control,
+		g.time_bonus,
+		g.control_type,
+		g.time_stages,
+		g.result,
+		g.moves_length,
+		g.moves,
+		g.termination,
+		g.time_differences,
+		0,
+		0,
+		g.created_at,
+		COALESCE(g.fen, '')
+	FROM casual_game g
+	INNER JOIN player w ON g.white_id = w.id
+	INNER JOIN player b ON g.black_id = b.id
+	WHERE g.id = ? AND g.termination != 1`
+
+	selectNewestCasual = `
+	SELECT
+		w.name AS w_name,
+		b.name AS b_name,
+	    g.result,
+	    g.termination,
+	    g.time_control,
+   	    g.time_bonus,
+	    g.control_type,
+	    g.time_stages,
+	    g.moves_length,
+	    g.created_at,
+	    g.id,
+		g.white_id,
+		g.black_id
+	FROM casual_game g
+	INNER JOIN player w ON g.white_id = w.id
+	INNER JOIN player b ON g.black_id = b.id
+	WHERE
+		(g.white_id = ? OR g.black_id = ?)
+	    AND g.termination != 1
+	ORDER BY g.created_at DESC, g.id DESC
+	LIMIT 100`
+
+	selectOlderCasual = `
+	SELECT
+		w.name AS w_name,
+		b.name AS b_name,
+		g.result,
+		g.termination,
+		g.time_control,
+		g.time_bonus,
+		g.control_type,
+		g.time_stages,
+		g.moves_length,
+		g.created_at,
+		g.id,
+		g.white_id,
+		g.black_id
+	FROM casual_game g
+	INNER JOIN player w ON g.white_id = w.id
+	INNER JOIN player b ON g.black_id = b.id
+	WHERE
+		(g.white_id = ? OR g.black_id = ?)
+		AND g.termination != 1
+		AND (
+			(g.created_at = ? AND g.id < ?)
+	        OR g.created_at < ?
+	    )
+	ORDER BY g.created_at DESC, g.id DESC
+	LIMIT 100`
+
+	updateCasual = `
+	UPDATE casual_game
 	SET
 		result = ?,
 		termination = ?,
@@ -397,16 +1163,18 @@ const (
 		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?`
 
-	markRatedAsAbandoned = `UPDATE rated_game SET termination = 1 WHERE id = ?`
+	markCasualAsAbandoned = `
+	UPDATE casual_game SET termination = 1 WHERE id = ? AND termination = 0`
 
 	insertEngine = `
 	INSERT INTO engine_game (
 		id,
 		player_id,
 		player_color,
-		difficulty
+		difficulty,
+		fen
 	)
-	VALUES (?, ?, ?, ?)`
+	VALUES (?, ?, ?, ?, NULLIF(?, ''))`
 
 	selectEngine = `
 	SELECT
@@ -422,7 +1190,9 @@ const (
 		g.moves_length,
 		g.moves,
 		g.player_color,
-		g.difficulty
+		g.difficulty,
+		g.created_at,
+		COALESCE(g.fen, '')
 	FROM engine_game g
 	INNER JOIN player p ON g.player_id = p.id
 	WHERE g.id = ? AND g.termination != 1`
@@ -460,5 +1230,111 @@ const (
 		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?`
 
-	markEngineAsAbandoned = `UPDATE engine_game SET termination = 1 WHERE id = ?`
+	markEngineAsAbandoned = `
+	UPDATE engine_game SET termination = 1 WHERE id = ? AND termination = 0`
+
+	insertCorrespondence = `
+	INSERT INTO correspondence_game (
+		id,
+		white_id,
+		black_id,
+		days_per_move,
+		move_deadline
+	)
+	VALUES (?, ?, ?, ?, ?)`
+
+	selectCorrespondence = `
+	SELECT
+		w.id AS w_id,
+		w.name AS w_name,
+		w.rating AS w_rating,
+		w.rating_deviation AS w_rating_deviation,
+		w.rating_volatility AS w_rating_volatility,
+
+		b.id AS b_id,
+		b.name AS b_name,
+		b.rating AS b_rating,
+		b.rating_deviation AS b_rating_deviation,
+		b.rating_volatility AS b_rating_volatility,
+
+		g.id,
+		g.days_per_move,
+		g.move_deadline,
+		g.result,
+		g.moves_length,
+		g.moves,
+		g.termination
+	FROM correspondence_game g
+	INNER JOIN player w ON g.white_id = w.id
+	INNER JOIN player b ON g.black_id = b.id
+	WHERE g.id = ? AND g.termination != 1`
+
+	selectExpiredCorrespondence = `
+	SELECT id FROM correspondence_game
+	WHERE termination = ? AND move_deadline < ?`
+
+	updateCorrespondence = `
+	UPDATE correspondence_game
+	SET
+		result = ?,
+		termination = ?,
+		moves_length = ?,
+		moves = ?,
+		move_deadline = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND moves_length = ? AND termination = ?`
+
+	upsertCheckpoint = `
+	INSERT INTO game_checkpoint (id, kind, state)
+	VALUES (?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+		state = VALUES(state),
+		updated_at = CURRENT_TIMESTAMP`
+
+	selectCheckpoints = `SELECT id, kind, state, updated_at FROM game_checkpoint`
+
+	deleteCheckpoint = `DELETE FROM game_checkpoint WHERE id = ?`
+
+	selectRatedTermination  = `SELECT termination FROM rated_game WHERE id = ?`
+	selectCasualTermination = `SELECT termination FROM casual_game WHERE id = ?`
+	selectEngineTermination = `SELECT termination FROM engine_game WHERE id = ?`
+
+	insertImported = `
+	INSERT INTO imported_game (
+		id,
+		player_id,
+		white_name,
+		black_name,
+		result,
+		moves_length,
+		moves,
+		headers
+	)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	selectImported = `
+	SELECT
+		id, player_id, white_name, black_name, result, moves_length, moves,
+		headers, created_at
+	FROM imported_game
+	WHERE id = ?`
+
+	selectNewestImported = `
+	SELECT id, white_name, black_name, result, moves_length, created_at
+	FROM imported_game
+	WHERE player_id = ?
+	ORDER BY created_at DESC, id DESC
+	LIMIT 100`
+
+	selectOlderImported = `
+	SELECT id, white_name, black_name, result, moves_length, created_at
+	FROM imported_game
+	WHERE
+		player_id = ?
+		AND (
+			(created_at = ? AND id < ?)
+	        OR created_at < ?
+	    )
+	ORDER BY created_at DESC, id DESC
+	LIMIT 100`
 )
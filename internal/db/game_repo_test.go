@@ -0,0 +1,27 @@
+package db
+
+import "testing"
+
+func TestCategory(t *testing.T) {
+	cases := []struct {
+		tc       TimeControl
+		expected Category
+	}{
+		{TimeControl{Control: 60}, Bullet},
+		{TimeControl{Control: 120, Bonus: 1}, Bullet},
+		{TimeControl{Control: 180, Bonus: 2}, Blitz},
+		{TimeControl{Control: 600, Bonus: 5, Type: Delay}, Rapid},
+		{TimeControl{Control: 900, Bonus: 10, Type: Bronstein}, Rapid},
+		{TimeControl{Control: 1800}, Classical},
+		// Stage time counts towards the duration.
+		{TimeControl{Control: 300, Stages: Stages{{Move: 40, Time: 300}}}, Rapid},
+		{TimeControl{Control: 5400, Bonus: 30, Stages: Stages{{Move: 40, Time: 1800}}}, Classical},
+		{TimeControl{Control: 60, Stages: Stages{{Move: 20, Time: 60}, {Move: 40, Time: 60}}}, Blitz},
+	}
+
+	for i, tc := range cases {
+		if got := tc.tc.Category(); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+	}
+}
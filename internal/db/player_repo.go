@@ -2,13 +2,21 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 )
 
+// ErrStaleRatings is returned by [PlayerRepo.ReplaceRatings] if rated games
+// have been completed since the results were selected.
+var ErrStaleRatings = errors.New("db: rated games have been completed concurrently")
+
 // Player represents a registered player.
 type Player struct {
-	Id         string
-	Name       string
+	Id   string
+	Name string
+	// Glicko-2 rating in the category selected with [PlayerRepo.SelectById].
+	// Players selected otherwise have the rating shared by all categories, which
+	// is used as the initial rating in each category.
 	Rating     float64
 	Deviation  float64
 	Volatility float64
@@ -21,13 +29,21 @@ type Profile struct {
 	Id        string
 	CreatedAt time.Time
 	Name      string
-	Rating    float64
-	// Number of played rated games.
+	// Rating in the category of the leaderboard.
+	Rating float64
+	// Ratings and their deviations in each category.  Filled only by
+	// [PlayerRepo.SelectProfile].
+	Ratings    [len(Categories)]float64
+	Deviations [len(Categories)]float64
+	// Number of played rated games.  [PlayerRepo.SelectLeaderboard] counts only
+	// the games in the category of the leaderboard.
 	RatedGames  int
+	CasualGames int
 	EngineGames int
 }
 
-// RatingUpdate is used to update the player's rating after completed game.
+// RatingUpdate is used to update the player's rating after completed game.  See
+// [GameRepo.FinalizeRated].
 type RatingUpdate struct {
 	Id         string
 	Rating     float64
@@ -35,14 +51,63 @@ type RatingUpdate struct {
 	Volatility float64
 }
 
+// RatingPoint is the player's rating in the category after the rated game.
+type RatingPoint struct {
+	CreatedAt time.Time `json:"t"`
+	GameId    string    `json:"g"`
+	Rating    float64   `json:"r"`
+	Category  Category  `json:"c"`
+}
+
+// CategoryRating is the player's rating in the category.
+type CategoryRating struct {
+	LastGameAt time.Time
+	Id         string
+	Category   Category
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+	// Number of rating periods for which the deviation has already been
+	// increased since the last game.
+	DecayedPeriods int
+}
+
+// RecomputedGame describes the rating changes of the players after the rated
+// game which has been replayed with the new rating parameters.
+type RecomputedGame struct {
+	RatedResult
+	White RatingChange
+	Black RatingChange
+}
+
 // PlayerRepo ignores guest players.
 type PlayerRepo interface {
-	SelectById(id string) (Player, error)
+	// SelectById selects the player along with their rating in the category.
+	SelectById(id string, c Category) (Player, error)
 	SelectProfile(id string) (Profile, error)
 	// SelectLeaderboard selects [Profile] of 100 players with the biggest
-	// rating sorted in descending order.
-	SelectLeaderboard() ([]Profile, error)
-	UpdateRatings(white, black RatingUpdate) error
+	// rating in the category sorted in descending order.  Only players who
+	// have completed rated games in the category are listed.
+	SelectLeaderboard(c Category) ([]Profile, error)
+	// SelectRatingHistory selects the player's ratings after each rated game
+	// in all categories sorted by the date.
+	SelectRatingHistory(id string) ([]RatingPoint, error)
+	// SelectInactiveRatings selects ratings which deviation is less than the
+	// specified one and the last game in the category was completed before the
+	// specified time.
+	SelectInactiveRatings(before time.Time, deviation float64) ([]CategoryRating, error)
+	// UpdateDeviation stores the increased deviation along with the number of
+	// rating periods it was increased for.
+	UpdateDeviation(id string, c Category, deviation float64, periods int) error
+	// SelectRatings selects ratings of all players in all categories.
+	SelectRatings() ([]CategoryRating, error)
+	// ReplaceRatings atomically replaces ratings of all players, rating changes
+	// stored in the rated games and the rating history with the recomputed
+	// ones.  Games must contain all completed rated games.  Completed rated games
+	// are locked until the commit, and [ErrStaleRatings] is returned if their
+	// number differs.  The server should be stopped anyway, since ratings of the
+	// games played meanwhile are overwritten.
+	ReplaceRatings(games []RecomputedGame, ratings []CategoryRating) error
 }
 
 // SQLPlayerRepo wraps the database connection pool and implements [PlayerRepo].
@@ -52,8 +117,8 @@ type SQLPlayerRepo struct {
 
 func NewSQLPlayerRepo(p *sql.DB) SQLPlayerRepo { return SQLPlayerRepo{pool: p} }
 
-func (r SQLPlayerRepo) SelectById(id string) (Player, error) {
-	row := r.pool.QueryRow(selectPlayerById, id)
+func (r SQLPlayerRepo) SelectById(id string, c Category) (Player, error) {
+	row := r.pool.QueryRow(selectPlayerById, c, id)
 	var p Player
 	return p, row.Scan(&p.Id, &p.Name, &p.Rating, &p.Deviation, &p.Volatility)
 }
@@ -61,11 +126,40 @@ func (r SQLPlayerRepo) SelectById(id string) (Player, error) {
 func (r SQLPlayerRepo) SelectProfile(id string) (Profile, error) {
 	row := r.pool.QueryRow(selectProfile, id)
 	var p Profile
-	return p, row.Scan(&p.Name, &p.Rating, &p.CreatedAt, &p.RatedGames)
+	var deviation float64
+	if err := row.Scan(
+		&p.Name, &p.Rating, &deviation, &p.CreatedAt, &p.RatedGames,
+		&p.CasualGames,
+	); err != nil {
+		return p, err
+	}
+
+	// Categories without rated games have the shared rating.
+	for i := range p.Ratings {
+		p.Ratings[i], p.Deviations[i] = p.Rating, deviation
+	}
+
+	rows, err := r.pool.Query(selectCategoryRatings, id)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Category
+		var rating, deviation float64
+		if err = rows.Scan(&c, &rating, &deviation); err != nil {
+			return p, err
+		}
+		if c >= 0 && int(c) < len(p.Ratings) {
+			p.Ratings[c], p.Deviations[c] = rating, deviation
+		}
+	}
+	return p, rows.Err()
 }
 
-func (r SQLPlayerRepo) SelectLeaderboard() ([]Profile, error) {
-	rows, err := r.pool.Query(selectLeaderboard)
+func (r SQLPlayerRepo) SelectLeaderboard(c Category) ([]Profile, error) {
+	rows, err := r.pool.Query(selectLeaderboard, c)
 	if err != nil {
 		return nil, err
 	}
@@ -83,69 +177,259 @@ func (r SQLPlayerRepo) SelectLeaderboard() ([]Profile, error) {
 	return leaders, err
 }
 
-func (r SQLPlayerRepo) UpdateRatings(white, black RatingUpdate) error {
-	_, err := r.pool.Exec(updateRatings,
-		white.Id, white.Rating, black.Id, black.Rating,
-		white.Id, white.Deviation, black.Id, black.Deviation,
-		white.Id, white.Volatility, black.Id, black.Volatility,
-		white.Id, black.Id,
-	)
+func (r SQLPlayerRepo) SelectRatingHistory(id string) ([]RatingPoint, error) {
+	rows, err := r.pool.Query(selectRatingHistory, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]RatingPoint, 0)
+	for rows.Next() {
+		var p RatingPoint
+		if err = rows.Scan(&p.CreatedAt, &p.GameId, &p.Rating, &p.Category); err != nil {
+			return nil, err
+		}
+		history = append(history, p)
+	}
+	return history, rows.Err()
+}
+
+func (r SQLPlayerRepo) SelectInactiveRatings(
+	before time.Time, deviation float64,
+) ([]CategoryRating, error) {
+	rows, err := r.pool.Query(selectInactiveRatings, before, deviation)
+	if err != nil {
+		return nil, err
+	}
+	return scanCategoryRatings(rows)
+}
+
+func (r SQLPlayerRepo) UpdateDeviation(
+	id string, c Category, deviation float64, periods int,
+) error {
+	_, err := r.pool.Exec(updateDeviation, deviation, periods, id, c)
 	return err
 }
 
+func (r SQLPlayerRepo) SelectRatings() ([]CategoryRating, error) {
+	rows, err := r.pool.Query(selectRatings)
+	if err != nil {
+		return nil, err
+	}
+	return scanCategoryRatings(rows)
+}
+
+func (r SQLPlayerRepo) ReplaceRatings(
+	games []RecomputedGame, ratings []CategoryRating,
+) error {
+	tx, err := r.pool.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback has no effect after the commit.
+	defer tx.Rollback()
+
+	var completed int
+	if err = tx.QueryRow(lockRatedResults).Scan(&completed); err != nil {
+		return err
+	}
+	if completed != len(games) {
+		return ErrStaleRatings
+	}
+
+	if _, err = tx.Exec(deleteRatingHistory); err != nil {
+		return err
+	}
+	for _, g := range games {
+		c := g.Control.Category()
+		if _, err = tx.Exec(
+			updateRatingChanges, g.White.Rating, g.White.Delta,
+			g.Black.Rating, g.Black.Delta, g.Id,
+		); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(insertReplayedHistory,
+			g.WhiteId, g.Id, c, g.White.Rating+g.White.Delta, g.CompletedAt,
+			g.BlackId, g.Id, c, g.Black.Rating+g.Black.Delta, g.CompletedAt,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec(deleteRatings); err != nil {
+		return err
+	}
+	for _, cr := range ratings {
+		if _, err = tx.Exec(insertRating,
+			cr.Id, cr.Category, cr.Rating, cr.Deviation, cr.Volatility,
+			cr.DecayedPeriods, cr.LastGameAt,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// scanCategoryRatings scans and closes the rows.
+func scanCategoryRatings(rows *sql.Rows) ([]CategoryRating, error) {
+	defer rows.Close()
+
+	ratings := make([]CategoryRating, 0)
+	for rows.Next() {
+		var cr CategoryRating
+		if err := rows.Scan(
+			&cr.Id, &cr.Category, &cr.Rating, &cr.Deviation, &cr.Volatility,
+			&cr.DecayedPeriods, &cr.LastGameAt,
+		); err != nil {
+			return nil, err
+		}
+		ratings = append(ratings, cr)
+	}
+	return ratings, rows.Err()
+}
+
 const (
+	// Players who haven't completed rated games in the category have the
+	// shared rating.
 	selectPlayerById = `
-	SELECT id, name, rating, rating_deviation, rating_volatility
-	FROM player WHERE id = ? AND is_guest = FALSE`
+	SELECT
+		p.id,
+		p.name,
+		COALESCE(r.rating, p.rating),
+		COALESCE(r.rating_deviation, p.rating_deviation),
+		COALESCE(r.rating_volatility, p.rating_volatility)
+	FROM player p
+	LEFT JOIN player_rating r
+	ON r.player_id = p.id AND r.category = ?
+	WHERE p.id = ? AND p.is_guest = FALSE`
+
+	selectCategoryRatings = `
+	SELECT category, rating, rating_deviation
+	FROM player_rating WHERE player_id = ?`
 
 	selectProfile = `
 	SELECT
 		p.name,
 		p.rating,
+		p.rating_deviation,
 		p.created_at,
-		count(g.id) as num_of_games
+		count(g.id) as num_of_games,
+		(
+			SELECT count(c.id) FROM casual_game c
+			WHERE
+				(c.white_id = p.id OR c.black_id = p.id)
+				AND c.termination != 1
+		) as num_of_casual_games
 	FROM player p
 	LEFT JOIN rated_game g
 	ON
 		(g.white_id = p.id OR g.black_id = p.id)
 		AND g.termination != 1
 	WHERE p.id = ? AND p.is_guest = FALSE
-	GROUP BY p.name, p.rating, p.created_at`
+	GROUP BY p.name, p.rating, p.rating_deviation, p.created_at`
 
+	// Each rated game is stored in the history of its category.
 	selectLeaderboard = `
 	SELECT
 		p.id,
 		p.name,
-	    p.rating,
+	    r.rating,
 	    p.created_at,
-	    count(g.id) as num_of_games
+	    count(h.game_id) as num_of_games
 	FROM player p
-	LEFT JOIN rated_game g
-	ON
-		(g.white_id = p.id OR g.black_id = p.id)
-	    AND g.termination != 1
+	INNER JOIN player_rating r
+	ON r.player_id = p.id AND r.category = ?
+	LEFT JOIN rating_history h
+	ON h.player_id = p.id AND h.category = r.category
 	WHERE p.is_guest = FALSE
-	GROUP BY p.id, p.name, p.rating, p.created_at
-	ORDER BY p.rating DESC, num_of_games DESC
+	GROUP BY p.id, p.name, r.rating, p.created_at
+	ORDER BY r.rating DESC, num_of_games DESC
 	LIMIT 100`
 
-	updateRatings = `
-	UPDATE player
+	// The deviation is no longer decayed after the game.
+	upsertRatings = `
+	INSERT INTO player_rating (
+		player_id, category, rating, rating_deviation, rating_volatility,
+		decayed_periods, last_game_at
+	)
+	VALUES
+		(?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP),
+		(?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP)
+	ON DUPLICATE KEY UPDATE
+		rating = VALUES(rating),
+		rating_deviation = VALUES(rating_deviation),
+		rating_volatility = VALUES(rating_volatility),
+		decayed_periods = 0,
+		last_game_at = CURRENT_TIMESTAMP`
+
+	insertRatingHistory = `
+	INSERT INTO rating_history (player_id, game_id, category, rating)
+	VALUES (?, ?, ?, ?), (?, ?, ?, ?)`
+
+	selectRatingHistory = `
+	SELECT h.created_at, h.game_id, h.rating, h.category
+	FROM rating_history h
+	INNER JOIN player p ON h.player_id = p.id
+	WHERE h.player_id = ? AND p.is_guest = FALSE
+	ORDER BY h.created_at`
+
+	selectInactiveRatings = `
+	SELECT
+		player_id,
+		category,
+		rating,
+		rating_deviation,
+		rating_volatility,
+		decayed_periods,
+		last_game_at
+	FROM player_rating
+	WHERE last_game_at < ? AND rating_deviation < ?`
+
+	updateDeviation = `
+	UPDATE player_rating
+	SET rating_deviation = ?, decayed_periods = ?
+	WHERE player_id = ? AND category = ?`
+
+	selectRatings = `
+	SELECT
+		player_id,
+		category,
+		rating,
+		rating_deviation,
+		rating_volatility,
+		decayed_periods,
+		last_game_at
+	FROM player_rating
+	ORDER BY player_id, category`
+
+	deleteRatings = `DELETE FROM player_rating`
+
+	insertRating = `
+	INSERT INTO player_rating (
+		player_id, category, rating, rating_deviation, rating_volatility,
+		decayed_periods, last_game_at
+	)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	lockRatedResults = `
+	SELECT COUNT(*)
+	FROM rated_game
+	WHERE termination NOT IN (0, 1)
+	FOR UPDATE`
+
+	deleteRatingHistory = `DELETE FROM rating_history`
+
+	insertReplayedHistory = `
+	INSERT INTO rating_history (player_id, game_id, category, rating, created_at)
+	VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)`
+
+	updateRatingChanges = `
+	UPDATE rated_game
 	SET
-		rating = CASE
-			WHEN id = ? THEN ?
-			WHEN id = ? THEN ?
-			ELSE rating
-		END,
-		rating_deviation = CASE
-			WHEN id = ? THEN ?
-			WHEN id = ? THEN ?
-			ELSE rating_deviation
-		END,
-		rating_volatility = CASE
-			WHEN id = ? THEN ?
-			WHEN id = ? THEN ?
-			ELSE rating_volatility
-		END
-	WHERE (player.id = ? OR player.id = ?) AND player.is_guest = FALSE`
+		white_rating = ?,
+		white_rating_delta = ?,
+		black_rating = ?,
+		black_rating_delta = ?
+	WHERE id = ?`
 )
@@ -26,24 +26,61 @@ const (
 	ClientsCounter
 	Redirect
 	Error
+	// TakebackOffer is sent by the player to undo their last move.  The same
+	// event is forwarded to the opponent, who may accept or decline the offer.
+	TakebackOffer
+	TakebackAccept
+	TakebackDecline
+	// ClaimDraw is sent by the player to claim a draw by the threefold repetition
+	// or the fifty-move rule.
+	ClaimDraw
+	// SpectatorsCounter is the number of connected spectators.  ClientsCounter
+	// counts only players.
+	SpectatorsCounter
+	// Premove is sent by the player to queue the move in the UCI notation while
+	// it isn't their turn.
+	Premove
+	// CancelPremove is sent by the player to cancel the queued move.  The same
+	// event is sent to the player if the premove was illegal.
+	CancelPremove
+	// Challenge is sent to the challenged player.  ChallengeAccept and
+	// ChallengeDecline are sent by the challenged player with the challenge id
+	// as the payload.
+	Challenge
+	ChallengeAccept
+	ChallengeDecline
+	// ChallengeExpire is sent to both players when the challenge expires.
+	ChallengeExpire
+	// RematchOffer is sent by the player after the game is terminated.  The
+	// same event is forwarded to the opponent, who may accept or decline the
+	// offer.  RematchDecline is sent to both players.
+	RematchOffer
+	RematchAccept
+	RematchDecline
 )
 
 type Event struct {
-	Payload  json.RawMessage `json:"p"`
-	Kind     Kind            `json:"k"`
-	SenderId string          `json:"-"`
+	Payload json.RawMessage `json:"p"`
+	Kind    Kind            `json:"k"`
+	// Sequence number of the event sent by the room.  Zero for events which
+	// aren't numbered.
+	Seq      uint64 `json:"s,omitempty"`
+	SenderId string `json:"-"`
 }
 
 // JSON returns encoded event.  Errors are ignored.
-func JSON(k Kind, p any) json.RawMessage {
+func JSON(k Kind, p any) json.RawMessage { return Numbered(k, p, 0) }
+
+// Numbered returns encoded event with the specified sequence number.  Errors
+// are ignored.
+func Numbered(k Kind, p any, seq uint64) json.RawMessage {
 	rawPayload, err := json.Marshal(p)
 	if err != nil {
 		log.Print(err)
 	}
-	rawEvent, err := json.Marshal(Event{Kind: k, Payload: rawPayload})
+	rawEvent, err := json.Marshal(Event{Kind: k, Payload: rawPayload, Seq: seq})
 	if err != nil {
 		log.Print(err)
 	}
 	return rawEvent
-
 }
@@ -0,0 +1,46 @@
+package game
+
+import (
+	"justchess/internal/db"
+	"log"
+)
+
+// CasualGame is a game between two players which doesn't affect their ratings.
+// Guests are allowed to play casual games.
+type CasualGame struct {
+	liveGame
+
+	gameRepo db.GameRepo
+}
+
+// SpawnCasualGame inserts a new casual game record into repository and
+// initializes [CasualGame] fields.  The game starts from the position specified
+// by FEN, which must be validated beforehand, or from the standard one if it's
+// empty.
+func SpawnCasualGame(
+	white, black db.Player, tc db.TimeControl, fen string,
+	id string, gr db.GameRepo,
+) (*CasualGame, error) {
+	if err := gr.InsertCasual(id, white.Id, black.Id, tc, fen); err != nil {
+		return nil, err
+	}
+	return newCasualGame(newLiveGame(id, white, black, tc, fen), gr), nil
+}
+
+func newCasualGame(lg liveGame, gr db.GameRepo) *CasualGame {
+	g := &CasualGame{liveGame: lg, gameRepo: gr}
+	g.persist = g.store
+	g.markAbandoned = gr.MarkCasualAsAbandoned
+	return g
+}
+
+// Checkpoint returns the state of the game required to restore it.
+func (g *CasualGame) Checkpoint() (db.Checkpoint, error) {
+	return newCheckpoint(g.id, db.CasualKind, g.state())
+}
+
+func (g *CasualGame) store() {
+	if err := g.gameRepo.UpdateCasual(g.update()); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,184 @@
+package game
+
+import (
+	"encoding/json"
+	"errors"
+
+	"justchess/internal/db"
+	"justchess/internal/position"
+
+	"github.com/treepeck/chego"
+)
+
+var errCheckpoint = errors.New("game: malformed checkpoint")
+
+// liveState is the serializable state of the [liveGame].
+type liveState struct {
+	White          db.Player      `json:"w"`
+	Black          db.Player      `json:"b"`
+	Control        db.TimeControl `json:"tc"`
+	FEN            string         `json:"f,omitempty"`
+	Indices        []byte         `json:"i"`
+	TimeDiffs      []int          `json:"td"`
+	Clock          clockState     `json:"c"`
+	DrawIssuer     string         `json:"di,omitempty"`
+	TakebackIssuer string         `json:"ti,omitempty"`
+	RematchIssuer  string         `json:"ri,omitempty"`
+	WhitePremove   string         `json:"wp,omitempty"`
+	BlackPremove   string         `json:"bp,omitempty"`
+	// Flags of the players' offers.
+	DidWhiteOfferDraw     bool `json:"wd,omitempty"`
+	DidBlackOfferDraw     bool `json:"bd,omitempty"`
+	DidWhiteOfferTakeback bool `json:"wt,omitempty"`
+	DidBlackOfferTakeback bool `json:"bt,omitempty"`
+	IsWhiteOnline         bool `json:"wo,omitempty"`
+	IsBlackOnline         bool `json:"bo,omitempty"`
+	IsRematched           bool `json:"rm,omitempty"`
+}
+
+// engineState is the serializable state of the [EngineGame].
+type engineState struct {
+	Indices         []byte         `json:"i"`
+	PlayerId        string         `json:"p"`
+	Settings        EngineSettings `json:"s"`
+	FEN             string         `json:"f,omitempty"`
+	PlayerColor     chego.Color    `json:"pc"`
+	PlayerReconnect int            `json:"r"`
+	IsPlayerOnline  bool           `json:"o,omitempty"`
+}
+
+func newCheckpoint(id string, k db.GameKind, state any) (db.Checkpoint, error) {
+	raw, err := json.Marshal(state)
+	return db.Checkpoint{State: raw, Id: id, Kind: k}, err
+}
+
+// Restore rebuilds the game from the checkpoint.
+//
+// Disconnects caused by the restart aren't charged, i.e. players who were online
+// at the moment of checkpoint get the full reconnect time.
+func Restore(cp db.Checkpoint, gr db.GameRepo, e Engine) (Game, error) {
+	if cp.Kind == db.EngineKind {
+		var s engineState
+		if err := json.Unmarshal(cp.State, &s); err != nil {
+			return nil, err
+		}
+		replayed, _, err := replay(s.FEN, s.Indices)
+		if err != nil {
+			return nil, err
+		}
+		g := &EngineGame{
+			Game:            replayed,
+			playedIndices:   s.Indices,
+			id:              cp.Id,
+			playerId:        s.PlayerId,
+			gameRepo:        gr,
+			engine:          e,
+			settings:        s.Settings,
+			fen:             s.FEN,
+			playerColor:     s.PlayerColor,
+			playerReconnect: s.PlayerReconnect,
+		}
+		if s.IsPlayerOnline {
+			g.playerReconnect = reconnectDeadline
+		}
+		return g, nil
+	}
+
+	var s liveState
+	if err := json.Unmarshal(cp.State, &s); err != nil {
+		return nil, err
+	}
+	if len(s.TimeDiffs) != len(s.Indices) {
+		return nil, errCheckpoint
+	}
+	lg, err := restoreLiveGame(cp.Id, s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cp.Kind {
+	case db.RatedKind:
+		return newRatedGame(lg, gr), nil
+	case db.CasualKind:
+		return newCasualGame(lg, gr), nil
+	}
+	return nil, errCheckpoint
+}
+
+func (g *liveGame) state() liveState {
+	return liveState{
+		White:                 g.white,
+		Black:                 g.black,
+		Control:               g.control,
+		FEN:                   g.fen,
+		Indices:               g.playedIndices,
+		TimeDiffs:             g.timeDiffs,
+		Clock:                 g.clock.state(),
+		DrawIssuer:            g.drawIssuer,
+		TakebackIssuer:        g.takebackIssuer,
+		RematchIssuer:         g.rematchIssuer,
+		WhitePremove:          g.whitePremove,
+		BlackPremove:          g.blackPremove,
+		DidWhiteOfferDraw:     g.didWhiteOfferDraw,
+		DidBlackOfferDraw:     g.bidBlackOfferDraw,
+		DidWhiteOfferTakeback: g.didWhiteOfferTakeback,
+		DidBlackOfferTakeback: g.didBlackOfferTakeback,
+		IsWhiteOnline:         g.isWhiteOnline,
+		IsBlackOnline:         g.isBlackOnline,
+		IsRematched:           g.isRematched,
+	}
+}
+
+// replay plays the moves of the specified indices from the position and
+// returns the FEN of each occurred position.  Returns [errCheckpoint] if any of
+// the indices doesn't denote the legal move.
+func replay(fen string, indices []byte) (chego.Game, []string, error) {
+	g := position.NewGame(fen)
+	positions := []string{chego.SerializeFEN(g.Position)}
+	for _, i := range indices {
+		if i >= g.Legal.LastMoveIndex {
+			return g, nil, errCheckpoint
+		}
+		g.Push(g.Legal.Moves[i])
+		positions = append(positions, chego.SerializeFEN(g.Position))
+	}
+	return g, positions, nil
+}
+
+func restoreLiveGame(id string, s liveState) (liveGame, error) {
+	g, positions, err := replay(s.FEN, s.Indices)
+	if err != nil {
+		return liveGame{}, err
+	}
+
+	c := restoreClock(s.Clock)
+	if s.IsWhiteOnline {
+		c.whiteReconnect = reconnectDeadline
+	}
+	if s.IsBlackOnline {
+		c.blackReconnect = reconnectDeadline
+	}
+
+	return liveGame{
+		Game:                  g,
+		white:                 s.White,
+		black:                 s.Black,
+		control:               s.Control,
+		fen:                   s.FEN,
+		playedIndices:         s.Indices,
+		positions:             positions,
+		timeDiffs:             s.TimeDiffs,
+		drawIssuer:            s.DrawIssuer,
+		takebackIssuer:        s.TakebackIssuer,
+		rematchIssuer:         s.RematchIssuer,
+		whitePremove:          s.WhitePremove,
+		blackPremove:          s.BlackPremove,
+		id:                    id,
+		clock:                 c,
+		didWhiteOfferDraw:     s.DidWhiteOfferDraw,
+		bidBlackOfferDraw:     s.DidBlackOfferDraw,
+		didWhiteOfferTakeback: s.DidWhiteOfferTakeback,
+		didBlackOfferTakeback: s.DidBlackOfferTakeback,
+		isRematched:           s.IsRematched,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package game
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/chego"
+)
+
+func TestRestoreLiveGame(t *testing.T) {
+	cases := []struct {
+		elapsed       time.Duration
+		isWhiteOnline bool
+		reconnect     int
+	}{
+		{0, true, reconnectDeadline},
+		{2 * time.Second, false, 12},
+		{10 * time.Second, true, reconnectDeadline},
+	}
+
+	for i, tc := range cases {
+		g := newLiveGame("id", db.Player{Id: "w"}, db.Player{Id: "b"},
+			db.TimeControl{Control: 60, Bonus: 1}, "")
+		g.clock.turnStart = time.Now().Add(-tc.elapsed)
+		g.clock.whiteReconnect = 12
+		g.isWhiteOnline = tc.isWhiteOnline
+		g.didWhiteOfferDraw = true
+		g.rematchIssuer = "b"
+		g.isRematched = true
+
+		// Simulate the round trip through the repository.
+		raw, err := json.Marshal(g.state())
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		var s liveState
+		if err = json.Unmarshal(raw, &s); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		// Time passed since the checkpoint must not be charged.
+		time.Sleep(10 * time.Millisecond)
+		restored, err := restoreLiveGame("id", s)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		expected := s.Clock.WhiteTime - s.Clock.Elapsed
+		got := restored.clock.timeLeft(chego.ColorWhite, chego.ColorWhite)
+		if got < expected-5 || got > expected {
+			t.Fatalf("case %d: expected: %d, got: %d", i, expected, got)
+		}
+		if restored.clock.whiteReconnect != tc.reconnect {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.reconnect,
+				restored.clock.whiteReconnect)
+		}
+		if !restored.didWhiteOfferDraw || restored.isWhiteOnline ||
+			restored.rematchIssuer != "b" || !restored.isRematched {
+			t.Fatalf("case %d: flags are not restored", i)
+		}
+	}
+}
+
+func TestRestoreIllegalIndex(t *testing.T) {
+	cases := []struct {
+		kind  db.GameKind
+		state any
+	}{
+		{db.RatedKind, liveState{Indices: []byte{0, 255}, TimeDiffs: []int{0, 0}}},
+		{db.CasualKind, liveState{Indices: []byte{255}, TimeDiffs: []int{0}}},
+		{db.EngineKind, engineState{Indices: []byte{0, 255}}},
+	}
+
+	for i, tc := range cases {
+		cp, err := newCheckpoint("id", tc.kind, tc.state)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		if _, err = Restore(cp, nil, nil); err != errCheckpoint {
+			t.Fatalf("case %d: expected: %v, got: %v", i, errCheckpoint, err)
+		}
+	}
+}
@@ -1,22 +1,202 @@
 package game
 
-// clock stores all time values in seconds.
+import (
+	"time"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/chego"
+)
+
+// Maximal amount of milliseconds which can be refunded to the player due to
+// the network latency.  Prevents abusing the compensation by delaying pong
+// responses.
+const maxLagCompensation = 500
+
+// clock stores players' time in milliseconds and reconnect time in seconds.
+//
+// Time spent on a move is measured using the monotonic clock reading, so wall
+// clock adjustments don't affect players' time.
 type clock struct {
+	// Moment when the active player's turn has started.
+	turnStart time.Time
+	stages    db.Stages
+	// Mover's time before each played move.  Used to restore the clock after
+	// takebacks.
+	history        []int
 	whiteTime      int
 	blackTime      int
 	whiteReconnect int
 	blackReconnect int
-	bonus          int
-	timeBeforeMove int
+	// Number of moves completed by each player.  Used to apply time stages.
+	whiteMoves int
+	blackMoves int
+	// Increment or delay in milliseconds depending on the control type.
+	bonus int
+	kind  db.ControlType
 }
 
-func newClock(control, bonus int) *clock {
+func newClock(tc db.TimeControl) *clock {
 	return &clock{
-		whiteTime:      control,
-		blackTime:      control,
+		turnStart:      time.Now(),
+		stages:         tc.Stages,
+		whiteTime:      tc.Control * 1000,
+		blackTime:      tc.Control * 1000,
 		whiteReconnect: reconnectDeadline,
 		blackReconnect: reconnectDeadline,
-		bonus:          bonus,
-		timeBeforeMove: control,
+		bonus:          tc.Bonus * 1000,
+		kind:           tc.Type,
 	}
 }
+
+// elapsed returns the number of milliseconds passed since the turn start.
+// Latency is the round-trip time in milliseconds.  Only the one-way delay is
+// subtracted, since the move event travels from client to server once.
+func (c *clock) elapsed(latency int) int {
+	ms := int(time.Since(c.turnStart).Milliseconds())
+	return max(ms-min(latency/2, maxLagCompensation), 0)
+}
+
+// charge returns the amount of milliseconds which must be subtracted from the
+// player's clock for the spent time.
+func (c *clock) charge(spent int) int {
+	if c.kind == db.Delay {
+		return max(spent-c.bonus, 0)
+	}
+	return spent
+}
+
+// refund returns the amount of milliseconds which must be added to the player's
+// clock after the completed move.
+func (c *clock) refund(spent int) int {
+	switch c.kind {
+	case db.Fischer:
+		return c.bonus
+	case db.Bronstein:
+		return min(spent, c.bonus)
+	}
+	return 0
+}
+
+// stageTime returns the amount of milliseconds which must be added to the
+// player's clock after the player completes the specified number of moves.
+func (c *clock) stageTime(moves int) int {
+	t := 0
+	for _, s := range c.stages {
+		if s.Move == moves {
+			t += s.Time * 1000
+		}
+	}
+	return t
+}
+
+// punch charges the player who has just completed the move for the spent time,
+// applies the bonus and starts the opponent's turn.  Returns the player's time
+// left in milliseconds.
+func (c *clock) punch(mover chego.Color, latency int) int {
+	spent := c.elapsed(latency)
+	c.turnStart = time.Now()
+
+	t, moves := &c.whiteTime, &c.whiteMoves
+	if mover == chego.ColorBlack {
+		t, moves = &c.blackTime, &c.blackMoves
+	}
+	c.history = append(c.history, *t)
+	*moves++
+	*t = max(*t-c.charge(spent), 0) + c.refund(spent) + c.stageTime(*moves)
+	return *t
+}
+
+// undo restores the mover's time before the last played move and restarts the
+// turn.
+func (c *clock) undo(mover chego.Color) {
+	if len(c.history) == 0 {
+		return
+	}
+	t := c.history[len(c.history)-1]
+	c.history = c.history[:len(c.history)-1]
+
+	if mover == chego.ColorWhite {
+		c.whiteTime = t
+		c.whiteMoves--
+	} else {
+		c.blackTime = t
+		c.blackMoves--
+	}
+	c.turnStart = time.Now()
+}
+
+// isFlagged reports whether the active player has run out of time.
+func (c *clock) isFlagged(active chego.Color, latency int) bool {
+	t := c.whiteTime
+	if active == chego.ColorBlack {
+		t = c.blackTime
+	}
+	return c.charge(c.elapsed(latency)) >= t
+}
+
+// timeLeft returns the player's time left in milliseconds taking into account
+// the time passed since the turn start if the player is active.
+func (c *clock) timeLeft(player, active chego.Color) int {
+	t := c.whiteTime
+	if player == chego.ColorBlack {
+		t = c.blackTime
+	}
+	if player == active {
+		t -= c.charge(c.elapsed(0))
+	}
+	return max(t, 0)
+}
+
+// clockState is the serializable clock state.  Elapsed is the time spent by the
+// active player on the current move in milliseconds.
+type clockState struct {
+	Stages         db.Stages      `json:"s,omitempty"`
+	History        []int          `json:"h"`
+	WhiteTime      int            `json:"wt"`
+	BlackTime      int            `json:"bt"`
+	WhiteReconnect int            `json:"wr"`
+	BlackReconnect int            `json:"br"`
+	WhiteMoves     int            `json:"wm"`
+	BlackMoves     int            `json:"bm"`
+	Elapsed        int            `json:"e"`
+	Bonus          int            `json:"b"`
+	Kind           db.ControlType `json:"k"`
+}
+
+func (c *clock) state() clockState {
+	return clockState{
+		Stages:         c.stages,
+		History:        c.history,
+		WhiteTime:      c.whiteTime,
+		BlackTime:      c.blackTime,
+		WhiteReconnect: c.whiteReconnect,
+		BlackReconnect: c.blackReconnect,
+		WhiteMoves:     c.whiteMoves,
+		BlackMoves:     c.blackMoves,
+		Elapsed:        c.elapsed(0),
+		Bonus:          c.bonus,
+		Kind:           c.kind,
+	}
+}
+
+// restoreClock restores the clock from the state.  The time passed since the
+// state was taken isn't charged, since players couldn't move meanwhile.
+func restoreClock(s clockState) *clock {
+	return &clock{
+		turnStart:      time.Now().Add(-time.Duration(s.Elapsed) * time.Millisecond),
+		stages:         s.Stages,
+		history:        s.History,
+		whiteTime:      s.WhiteTime,
+		blackTime:      s.BlackTime,
+		whiteReconnect: s.WhiteReconnect,
+		blackReconnect: s.BlackReconnect,
+		whiteMoves:     s.WhiteMoves,
+		blackMoves:     s.BlackMoves,
+		bonus:          s.Bonus,
+		kind:           s.Kind,
+	}
+}
+
+// toSeconds rounds the milliseconds to the nearest second.
+func toSeconds(ms int) int { return (ms + 500) / 1000 }
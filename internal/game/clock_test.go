@@ -0,0 +1,203 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/chego"
+)
+
+// Milliseconds which might pass while the test case runs.
+const tolerance = 50
+
+// ago returns the moment which was the specified number of milliseconds ago.
+func ago(ms int) time.Time {
+	return time.Now().Add(-time.Duration(ms) * time.Millisecond)
+}
+
+// isNear reports whether the measured time matches the expected one.
+func isNear(got, expected int) bool {
+	return got >= expected-tolerance && got <= expected+tolerance
+}
+
+func TestElapsed(t *testing.T) {
+	cases := []struct {
+		spent    int
+		latency  int
+		expected int
+	}{
+		{1000, 0, 1000},
+		// Only the one-way delay is compensated.
+		{1000, 400, 800},
+		// The compensation is capped.
+		{2000, 4000, 2000 - maxLagCompensation},
+		{100, 1000, 0},
+	}
+
+	for i, tc := range cases {
+		c := newClock(db.TimeControl{Control: 60})
+		c.turnStart = ago(tc.spent)
+
+		if got := c.elapsed(tc.latency); !isNear(got, tc.expected) {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.expected, got)
+		}
+	}
+}
+
+func TestPunch(t *testing.T) {
+	cases := []struct {
+		mover     chego.Color
+		spent     int
+		latency   int
+		white     int
+		black     int
+		timeLeft  int
+		whiteTime int
+		blackTime int
+	}{
+		{chego.ColorWhite, 1000, 0, 60000, 60000, 61000, 61000, 60000},
+		{chego.ColorBlack, 3000, 1000, 60000, 60000, 59500, 60000, 59500},
+		// The player's time cannot be negative before the bonus is added.
+		{chego.ColorWhite, 5000, 0, 1000, 60000, 2000, 2000, 60000},
+	}
+
+	for i, tc := range cases {
+		c := newClock(db.TimeControl{Control: 60, Bonus: 2, Type: db.Fischer})
+		c.whiteTime, c.blackTime = tc.white, tc.black
+		c.turnStart = ago(tc.spent)
+
+		if got := c.punch(tc.mover, tc.latency); !isNear(got, tc.timeLeft) {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.timeLeft, got)
+		}
+		if !isNear(c.whiteTime, tc.whiteTime) || !isNear(c.blackTime, tc.blackTime) {
+			t.Fatalf("case %d: expected: %d %d, got: %d %d", i, tc.whiteTime,
+				tc.blackTime, c.whiteTime, c.blackTime)
+		}
+		if len(c.history) != 1 || c.whiteMoves+c.blackMoves != 1 {
+			t.Fatalf("case %d: move isn't recorded", i)
+		}
+		// The opponent's turn starts.
+		if time.Since(c.turnStart) > tolerance*time.Millisecond {
+			t.Fatalf("case %d: turn isn't restarted", i)
+		}
+	}
+}
+
+func TestIsFlagged(t *testing.T) {
+	cases := []struct {
+		active   chego.Color
+		spent    int
+		latency  int
+		expected bool
+	}{
+		{chego.ColorWhite, 500, 0, false},
+		{chego.ColorWhite, 1200, 0, true},
+		{chego.ColorWhite, 1200, 1000, false},
+		// Black has more time.
+		{chego.ColorBlack, 1200, 0, false},
+		{chego.ColorBlack, 2200, 0, true},
+	}
+
+	for i, tc := range cases {
+		c := newClock(db.TimeControl{Control: 1})
+		c.blackTime = 2000
+		c.turnStart = ago(tc.spent)
+
+		if got := c.isFlagged(tc.active, tc.latency); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestTimeLeft(t *testing.T) {
+	cases := []struct {
+		player   chego.Color
+		active   chego.Color
+		spent    int
+		expected int
+	}{
+		{chego.ColorWhite, chego.ColorWhite, 1000, 59000},
+		// The time of the waiting player doesn't run.
+		{chego.ColorBlack, chego.ColorWhite, 1000, 60000},
+		{chego.ColorBlack, chego.ColorBlack, 2000, 58000},
+		{chego.ColorWhite, chego.ColorWhite, 70000, 0},
+	}
+
+	for i, tc := range cases {
+		c := newClock(db.TimeControl{Control: 60})
+		c.turnStart = ago(tc.spent)
+
+		if got := c.timeLeft(tc.player, tc.active); !isNear(got, tc.expected) {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.expected, got)
+		}
+	}
+}
+
+func TestRestoreClock(t *testing.T) {
+	cases := []db.TimeControl{
+		{Control: 60},
+		{Control: 180, Bonus: 2, Type: db.Fischer},
+		{Control: 5400, Bonus: 30, Type: db.Fischer, Stages: db.Stages{{Move: 40, Time: 1800}}},
+	}
+
+	for i, tc := range cases {
+		c := newClock(tc)
+		c.turnStart = ago(3000)
+		c.punch(chego.ColorWhite, 0)
+		c.whiteReconnect = 10
+		c.turnStart = ago(1500)
+
+		r := restoreClock(c.state())
+		if r.whiteTime != c.whiteTime || r.blackTime != c.blackTime ||
+			r.whiteReconnect != c.whiteReconnect || r.blackReconnect != c.blackReconnect ||
+			r.whiteMoves != c.whiteMoves || r.blackMoves != c.blackMoves ||
+			r.bonus != c.bonus || r.kind != c.kind ||
+			len(r.history) != len(c.history) || len(r.stages) != len(c.stages) {
+			t.Fatalf("case %d: expected: %v, got: %v", i, c.state(), r.state())
+		}
+		// The time spent on the current move is preserved.
+		if got := r.elapsed(0); !isNear(got, 1500) {
+			t.Fatalf("case %d: expected: %d, got: %d", i, 1500, got)
+		}
+	}
+}
+
+func TestControlType(t *testing.T) {
+	delay := db.TimeControl{Control: 60, Bonus: 2, Type: db.Delay}
+	bronstein := db.TimeControl{Control: 60, Bonus: 2, Type: db.Bronstein}
+	// 40/90+30: 90 minutes for the first 40 moves, then 30 more minutes.
+	staged := db.TimeControl{Control: 5400, Bonus: 30, Type: db.Fischer,
+		Stages: db.Stages{{Move: 40, Time: 1800}}}
+
+	cases := []struct {
+		tc    db.TimeControl
+		spent int
+		// Moves completed by white before the move.
+		moves    int
+		expected int
+	}{
+		// The clock doesn't run during the delay and the delay isn't added.
+		{delay, 0, 0, 60000},
+		{delay, 1500, 0, 60000},
+		{delay, 3000, 0, 59000},
+		// The refund is capped by the time spent.
+		{bronstein, 1500, 0, 60000},
+		{bronstein, 3000, 0, 59000},
+		// The stage time is added exactly after the 40th move.
+		{staged, 1000, 38, 5429000},
+		{staged, 1000, 39, 7229000},
+		{staged, 1000, 40, 5429000},
+	}
+
+	for i, tc := range cases {
+		c := newClock(tc.tc)
+		c.whiteMoves = tc.moves
+		c.turnStart = ago(tc.spent)
+
+		if got := c.punch(chego.ColorWhite, 0); !isNear(got, tc.expected) {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package game
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"justchess/internal/db"
+	"justchess/internal/position"
+
+	"github.com/treepeck/chego"
+)
+
+// Bounds of the correspondence time control.
+const (
+	MinDaysPerMove = 1
+	MaxDaysPerMove = 14
+)
+
+var errDaysPerMove = errors.New("game: days per move out of range")
+
+// CorrespondenceGame is a game between two players with days per move time
+// control.  The game is stored after each move, so it doesn't depend on the
+// room lifetime and can be loaded from the repository on demand.
+type CorrespondenceGame struct {
+	chego.Game
+
+	// Moment until which the active player must complete the move.
+	deadline time.Time
+	white    db.Player
+	black    db.Player
+	// Indices of played moves for Huffman coding.
+	playedIndices []byte
+	id            string
+	gameRepo      db.GameRepo
+	days          int
+}
+
+// SpawnCorrespondenceGame inserts a new correspondence game record into
+// repository and initializes [CorrespondenceGame] fields.
+func SpawnCorrespondenceGame(
+	white, black db.Player, days int, id string, gr db.GameRepo,
+) (*CorrespondenceGame, error) {
+	if days < MinDaysPerMove || days > MaxDaysPerMove {
+		return nil, errDaysPerMove
+	}
+	deadline := deadlineAfter(days)
+	if err := gr.InsertCorrespondence(id, white.Id, black.Id, days, deadline); err != nil {
+		return nil, err
+	}
+	return &CorrespondenceGame{
+		Game:          chego.NewGame(),
+		deadline:      deadline,
+		white:         white,
+		black:         black,
+		playedIndices: make([]byte, 0),
+		id:            id,
+		gameRepo:      gr,
+		days:          days,
+	}, nil
+}
+
+// LoadCorrespondenceGame selects the game from the repository and replays the
+// stored moves.
+func LoadCorrespondenceGame(id string, gr db.GameRepo) (*CorrespondenceGame, error) {
+	cg, err := gr.SelectCorrespondence(id)
+	if err != nil {
+		return nil, err
+	}
+
+	indices, g, ok := decodeIndices(cg.Encoded, cg.MovesLength)
+	if !ok {
+		return nil, errors.New("game: cannot decode moves of game " + id)
+	}
+	if cg.Termination != chego.Unterminated {
+		g.Terminate(cg.Termination, cg.Result)
+	}
+
+	return &CorrespondenceGame{
+		Game:          g,
+		deadline:      cg.Deadline,
+		white:         cg.White,
+		black:         cg.Black,
+		playedIndices: indices,
+		id:            id,
+		gameRepo:      gr,
+		days:          cg.DaysPerMove,
+	}, nil
+}
+
+// Play performs the move with the specified index and stores the game.  The
+// move is reverted if it cannot be stored, e.g. when the game has been updated
+// concurrently.  Latency is ignored.
+func (g *CorrespondenceGame) Play(id string, index byte, latency int) (MovePayload, bool) {
+	if (len(g.Played)%2 == 0 && id != g.white.Id) ||
+		(len(g.Played)%2 != 0 && id != g.black.Id) ||
+		g.Termination != chego.Unterminated ||
+		index >= g.Legal.LastMoveIndex {
+		return MovePayload{}, false
+	}
+
+	if time.Now().After(g.deadline) {
+		g.forfeit()
+		return MovePayload{}, false
+	}
+
+	prevLength, prevDeadline := len(g.Played), g.deadline
+
+	m := g.Legal.Moves[index]
+	g.Push(m)
+	g.playedIndices = append(g.playedIndices, index)
+	g.deadline = deadlineAfter(g.days)
+
+	if err := g.store(prevLength); err != nil {
+		log.Print(err)
+		g.playedIndices = g.playedIndices[:prevLength]
+		g.Game = position.Replay("", g.playedIndices)
+		g.deadline = prevDeadline
+		return MovePayload{}, false
+	}
+
+	return MovePayload{
+		Legal:      g.Legal.Moves[:g.Legal.LastMoveIndex],
+		PlayedMove: g.Played[len(g.Played)-1],
+		Move:       m,
+	}, true
+}
+
+func (g *CorrespondenceGame) Join(id string) {
+	log.Printf("player %s joins game %s", id, g.id)
+}
+
+func (g *CorrespondenceGame) Leave(id string) {
+	log.Printf("player %s leaves game %s", id, g.id)
+}
+
+func (g *CorrespondenceGame) IsPlayer(id string) bool {
+	return id == g.white.Id || id == g.black.Id
+}
+
+// TimeTick terminates the game if the active player has missed the deadline.
+// Disconnects are not tracked, since players aren't expected to stay online.
+func (g *CorrespondenceGame) TimeTick() {
+	if g.Termination == chego.Unterminated && time.Now().After(g.deadline) {
+		g.forfeit()
+	}
+}
+
+// forfeit terminates the game due to the time forfeit of the active player.
+func (g *CorrespondenceGame) forfeit() {
+	switch {
+	case g.IsInsufficientMaterial():
+		g.Terminate(chego.TimeForfeit, chego.Draw)
+	case len(g.Played) < minMoves:
+		g.Termination = chego.Abandoned
+	case g.Position.ActiveColor == chego.ColorBlack:
+		g.Terminate(chego.TimeForfeit, chego.WhiteWon)
+	default:
+		g.Terminate(chego.TimeForfeit, chego.BlackWon)
+	}
+
+	if err := g.store(len(g.Played)); err != nil {
+		log.Print(err)
+	}
+}
+
+func (g *CorrespondenceGame) Resign(id string) bool {
+	if len(g.Played) < minMoves || g.Termination != chego.Unterminated ||
+		(id != g.white.Id && id != g.black.Id) {
+		return false
+	}
+
+	if id == g.white.Id {
+		g.Terminate(chego.Resignation, chego.BlackWon)
+	} else {
+		g.Terminate(chego.Resignation, chego.WhiteWon)
+	}
+
+	if err := g.store(len(g.Played)); err != nil {
+		log.Print(err)
+		g.Game = position.Replay("", g.playedIndices)
+		return false
+	}
+	return true
+}
+
+// Abandon does nothing, since correspondence games outlive rooms.  Games
+// without enough moves are abandoned on the deadline instead.
+func (g *CorrespondenceGame) Abandon() {}
+
+// store updates the game record.  PrevLength is the number of moves in the
+// stored game.
+func (g *CorrespondenceGame) store(prevLength int) error {
+	return g.gameRepo.UpdateCorrespondence(db.CorrespondenceGameUpdate{
+		Deadline:     g.deadline,
+		EncodedMoves: chego.HuffmanEncoding(g.playedIndices),
+		Id:           g.id,
+		Result:       g.Result,
+		Termination:  g.Termination,
+		MovesLength:  len(g.Played),
+		PrevLength:   prevLength,
+	})
+}
+
+// deadlineAfter returns the deadline of the move which starts now.  The deadline
+// is computed only by the game and stored as is.
+func deadlineAfter(days int) time.Time {
+	return time.Now().Add(time.Duration(days) * 24 * time.Hour)
+}
+
+// timeLeft returns the number of milliseconds left until the deadline.
+func (g *CorrespondenceGame) timeLeft() int {
+	return max(int(time.Until(g.deadline).Milliseconds()), 0)
+}
+
+// GamePayload reports the time left until the deadline as the active player's
+// clock.
+func (g *CorrespondenceGame) GamePayload() GamePayload {
+	p := GamePayload{
+		Legal:  g.Legal.Moves[:g.Legal.LastMoveIndex],
+		Played: g.Played,
+	}
+	if g.Termination == chego.Unterminated {
+		if g.Position.ActiveColor == chego.ColorWhite {
+			p.WhiteTime = g.timeLeft()
+		} else {
+			p.BlackTime = g.timeLeft()
+		}
+	}
+	return p
+}
+
+func (g *CorrespondenceGame) EndPayload() EndPayload {
+	return EndPayload{
+		Result:      g.Result,
+		Termination: g.Termination,
+	}
+}
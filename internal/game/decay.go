@@ -0,0 +1,74 @@
+package game
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/glicko"
+)
+
+const (
+	// Glicko-2 rating period.  The deviation of the player who hasn't completed
+	// rated games in the category increases each period.
+	ratingPeriod = 7 * 24 * time.Hour
+	// Interval at which the deviations are decayed.
+	decayTick = time.Hour
+)
+
+// DecayDeviations periodically increases the deviations of inactive players,
+// so their ratings are treated as less reliable by the matchmaking and the
+// rating estimation.  Returns when the context is canceled.
+func DecayDeviations(ctx context.Context, pr db.PlayerRepo) {
+	ticker := time.NewTicker(decayTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := decayDeviations(pr, time.Now()); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// decayDeviations increases the deviations for the rating periods which have
+// passed since the last game and haven't been taken into account yet.  Thus
+// the deviation isn't increased twice for the same period.
+func decayDeviations(pr db.PlayerRepo, now time.Time) error {
+	ratings, err := pr.SelectInactiveRatings(
+		now.Add(-ratingPeriod), glicko.DefaultDeviation,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ratings {
+		periods := int(now.Sub(r.LastGameAt) / ratingPeriod)
+		if periods <= r.DecayedPeriods {
+			continue
+		}
+
+		d := decay(r.Deviation, r.Volatility, periods-r.DecayedPeriods)
+		if err = pr.UpdateDeviation(r.Id, r.Category, d, periods); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decay applies the Glicko-2 deviation increase for n rating periods without
+// games: phi' = sqrt(phi^2 + n*sigma^2).  The deviation cannot exceed the
+// initial one.
+func decay(deviation, volatility float64, n int) float64 {
+	phi := deviation / glicko.DefaultFactor
+	phi = math.Sqrt(phi*phi + float64(n)*volatility*volatility)
+	return min(phi*glicko.DefaultFactor, glicko.DefaultDeviation)
+}
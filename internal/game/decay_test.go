@@ -0,0 +1,77 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+)
+
+// decayRepo returns the single inactive rating and records its update.  Other
+// methods must not be called.
+type decayRepo struct {
+	db.PlayerRepo
+	rating    db.CategoryRating
+	deviation float64
+	periods   int
+}
+
+func (r *decayRepo) SelectInactiveRatings(time.Time, float64) ([]db.CategoryRating, error) {
+	return []db.CategoryRating{r.rating}, nil
+}
+
+func (r *decayRepo) UpdateDeviation(_ string, _ db.Category, d float64, periods int) error {
+	r.deviation, r.periods = d, periods
+	return nil
+}
+
+func TestDecayDeviations(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		lastGameAt time.Time
+		decayed    int
+		periods    int
+		deviation  float64
+	}{
+		{now.Add(-ratingPeriod / 2), 0, 0, 0},
+		// The deviation isn't increased twice for the same period.
+		{now.Add(-ratingPeriod - time.Hour), 1, 0, 0},
+		{now.Add(-ratingPeriod - time.Hour), 0, 1, decay(50, 0.06, 1)},
+		{now.Add(-3*ratingPeriod - time.Hour), 1, 3, decay(50, 0.06, 2)},
+	}
+
+	for i, tc := range cases {
+		r := &decayRepo{rating: db.CategoryRating{
+			LastGameAt: tc.lastGameAt, Deviation: 50, Volatility: 0.06,
+			DecayedPeriods: tc.decayed,
+		}}
+		if err := decayDeviations(r, now); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		if r.periods != tc.periods || r.deviation != tc.deviation {
+			t.Fatalf("case %d: expected: %d %f, got: %d %f",
+				i, tc.periods, tc.deviation, r.periods, r.deviation)
+		}
+	}
+}
+
+func TestDecay(t *testing.T) {
+	cases := []struct {
+		deviation float64
+		n         int
+		expected  float64
+	}{
+		{50, 0, 50},
+		// The deviation cannot exceed the initial one.
+		{340, 1000, 350},
+	}
+
+	for i, tc := range cases {
+		if got := decay(tc.deviation, 0.06, tc.n); got != tc.expected {
+			t.Fatalf("case %d: expected: %f, got: %f", i, tc.expected, got)
+		}
+	}
+	if decay(50, 0.06, 2) <= decay(50, 0.06, 1) {
+		t.Fatal("deviation doesn't increase with inactivity")
+	}
+}
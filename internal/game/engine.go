@@ -0,0 +1,271 @@
+package game
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"justchess/internal/db"
+)
+
+var (
+	errEngineExited  = errors.New("game: engine process has exited")
+	errEngineTimeout = errors.New("game: engine hasn't replied in time")
+	errNoEngine      = errors.New("game: engine games are disabled")
+	errEngineBusy    = errors.New("game: all engines are busy")
+)
+
+var (
+	// Time the engine has to reply in addition to the search time.  Variable to
+	// be shortened by tests.
+	engineGrace = 2 * time.Second
+	// Time the search waits for an idle engine of the pool.
+	engineWait = 5 * time.Second
+)
+
+// Engine is an adapter to the chess engine.  Implementations must be safe for
+// concurrent use.
+type Engine interface {
+	// BestMove searches for the best move in the position specified by FEN and
+	// returns it in the UCI long algebraic notation, e.g. "e2e4" or "e7e8q".
+	BestMove(fen string, s EngineSettings) (string, error)
+}
+
+// EngineSettings limits the engine strength.
+type EngineSettings struct {
+	// Skill level in range [0, 20].
+	Skill int
+	// Maximal search depth.  Zero means unlimited depth.
+	Depth int
+	// Search time in milliseconds.
+	MoveTime int
+}
+
+// engineSettings maps each [db.EngineDifficulty] to the engine settings.
+var engineSettings = map[db.EngineDifficulty]EngineSettings{
+	db.Easy:       {Skill: 0, Depth: 1, MoveTime: 100},
+	db.Medium:     {Skill: 5, Depth: 5, MoveTime: 300},
+	db.Hard:       {Skill: 10, Depth: 10, MoveTime: 500},
+	db.Insane:     {Skill: 15, Depth: 15, MoveTime: 1000},
+	db.Impossible: {Skill: 20, Depth: 0, MoveTime: 2000},
+}
+
+// UCIEngine communicates with a local engine process using the Universal Chess
+// Interface protocol.  Searches are performed one at a time, thus concurrent
+// games should use [EnginePool].  The engine which doesn't reply in time is
+// restarted, so a single hung search cannot block other games.
+type UCIEngine struct {
+	mu   sync.Mutex
+	path string
+	args []string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	// lines receives the engine output.  Closed when the process exits.
+	lines chan string
+}
+
+// StartUCIEngine starts the engine process and waits until it's ready to
+// accept commands.
+func StartUCIEngine(path string, args ...string) (*UCIEngine, error) {
+	e := &UCIEngine{path: path, args: args}
+	if err := e.start(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *UCIEngine) BestMove(fen string, s EngineSettings) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	line, err := e.search(fen, s)
+	if err != nil {
+		// The hung or exited engine is replaced, so the next search can
+		// succeed.
+		if rerr := e.restart(); rerr != nil {
+			log.Print(rerr)
+		}
+		return "", err
+	}
+
+	// Format: bestmove <move> [ponder <move>]
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[1] == "(none)" {
+		return "", errors.New("game: engine has no legal moves")
+	}
+	return fields[1], nil
+}
+
+// search starts the search and returns the bestmove line.  The engine is asked
+// to stop if it doesn't reply after the search time.
+func (e *UCIEngine) search(fen string, s EngineSettings) (string, error) {
+	if err := e.send(fmt.Sprintf("setoption name Skill Level value %d", s.Skill)); err != nil {
+		return "", err
+	}
+	if err := e.send("position fen " + fen); err != nil {
+		return "", err
+	}
+
+	cmd := fmt.Sprintf("go movetime %d", s.MoveTime)
+	if s.Depth > 0 {
+		cmd += fmt.Sprintf(" depth %d", s.Depth)
+	}
+	if err := e.send(cmd); err != nil {
+		return "", err
+	}
+
+	timeout := time.Duration(s.MoveTime)*time.Millisecond + engineGrace
+	line, err := e.await("bestmove", timeout)
+	if errors.Is(err, errEngineTimeout) && e.send("stop") == nil {
+		line, err = e.await("bestmove", engineGrace)
+	}
+	return line, err
+}
+
+// Close asks the engine to quit and waits for the process to exit.
+func (e *UCIEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.send("quit"); err != nil {
+		return err
+	}
+	e.in.Close()
+	return e.cmd.Wait()
+}
+
+// start starts the engine process and waits until it's ready to accept
+// commands.
+func (e *UCIEngine) start() error {
+	cmd := exec.Command(e.path, e.args...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(out)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+	e.cmd, e.in, e.lines = cmd, in, lines
+
+	if err = e.send("uci"); err != nil {
+		return err
+	}
+	if _, err = e.await("uciok", engineGrace); err != nil {
+		return err
+	}
+	if err = e.send("isready"); err != nil {
+		return err
+	}
+	_, err = e.await("readyok", engineGrace)
+	return err
+}
+
+// restart kills the engine process and starts a new one.
+func (e *UCIEngine) restart() error {
+	e.cmd.Process.Kill()
+	e.in.Close()
+	// Unblock the reader until the killed process closes its output.
+	go func(lines chan string) {
+		for range lines {
+		}
+	}(e.lines)
+	e.cmd.Wait()
+	return e.start()
+}
+
+func (e *UCIEngine) send(cmd string) error {
+	_, err := io.WriteString(e.in, cmd+"\n")
+	return err
+}
+
+// await skips the engine output until the line with the specified prefix.
+// Returns [errEngineTimeout] if the line isn't received in time.
+func (e *UCIEngine) await(prefix string, timeout time.Duration) (string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case line, ok := <-e.lines:
+			if !ok {
+				return "", errEngineExited
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line, nil
+			}
+		case <-timer.C:
+			return "", errEngineTimeout
+		}
+	}
+}
+
+// EnginePool runs several engine processes, so concurrent engine games don't
+// wait for each other.  The search fails with [errEngineBusy] if no engine gets
+// idle in time.
+type EnginePool struct {
+	idle    chan *UCIEngine
+	engines []*UCIEngine
+}
+
+// StartEnginePool starts the specified number of engine processes.
+func StartEnginePool(size int, path string, args ...string) (*EnginePool, error) {
+	p := &EnginePool{idle: make(chan *UCIEngine, size)}
+	for range size {
+		e, err := StartUCIEngine(path, args...)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.engines = append(p.engines, e)
+		p.idle <- e
+	}
+	return p, nil
+}
+
+func (p *EnginePool) BestMove(fen string, s EngineSettings) (string, error) {
+	timer := time.NewTimer(engineWait)
+	defer timer.Stop()
+
+	select {
+	case e := <-p.idle:
+		defer func() { p.idle <- e }()
+		return e.BestMove(fen, s)
+	case <-timer.C:
+		return "", errEngineBusy
+	}
+}
+
+// Close closes every engine of the pool.  Must not be called during searches.
+func (p *EnginePool) Close() error {
+	errs := make([]error, 0, len(p.engines))
+	for _, e := range p.engines {
+		errs = append(errs, e.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// EngineMove is the engine's reply found in the position after Ply moves.
+type EngineMove struct {
+	Err  error
+	Move string
+	Ply  int
+}
@@ -2,6 +2,7 @@ package game
 
 import (
 	"justchess/internal/db"
+	"justchess/internal/position"
 	"log"
 
 	"github.com/treepeck/chego"
@@ -11,37 +12,93 @@ type EngineGame struct {
 	chego.Game
 
 	// Indices of played moves for Huffman decoding.
-	playedIndices   []byte
-	id              string
-	playerId        string
-	gameRepo        db.GameRepo
+	playedIndices []byte
+	id            string
+	playerId      string
+	gameRepo      db.GameRepo
+	engine        Engine
+	settings      EngineSettings
+	// FEN of the starting position.  Empty for the standard one.
+	fen             string
 	playerColor     chego.Color
 	playerReconnect int
 	isPlayerOnline  bool
 }
 
 // SpawnEngineGame inserts a new engine game record into repository and initializes
-// [EngineGame] fields.
+// [EngineGame] fields.  The game starts from the position specified by FEN,
+// which must be validated beforehand, or from the standard one if it's empty.
 func SpawnEngineGame(id, playerId string, c chego.Color, d db.EngineDifficulty,
-	gr db.GameRepo) (*EngineGame, error) {
-	err := gr.InsertEngine(id, playerId, c, d)
+	fen string, gr db.GameRepo, e Engine) (*EngineGame, error) {
+	err := gr.InsertEngine(id, playerId, c, d, fen)
 	if err != nil {
 		return nil, err
 	}
 	return &EngineGame{
-		Game:            chego.NewGame(),
+		Game:            position.NewGame(fen),
+		fen:             fen,
 		id:              id,
 		playerId:        playerId,
 		playedIndices:   make([]byte, 0),
 		gameRepo:        gr,
+		engine:          e,
+		settings:        engineSettings[d],
 		playerColor:     c,
 		playerReconnect: reconnectDeadline,
 	}, nil
 }
 
-func (g *EngineGame) Play(id string, index byte) (MovePayload, bool) {
-	if id != g.playerId || g.Termination != chego.Unterminated ||
-		index >= g.Legal.LastMoveIndex {
+// Play performs the player's move with the specified index.  Latency is ignored
+// since engine games are played without clock.
+func (g *EngineGame) Play(id string, index byte, latency int) (MovePayload, bool) {
+	if id != g.playerId || g.Position.ActiveColor != g.playerColor {
+		return MovePayload{}, false
+	}
+	return g.play(index)
+}
+
+// Think starts the engine search in a separate goroutine if it's the engine's
+// turn.  The found move is sent to the specified channel and must be performed
+// with [EngineGame.PlayEngine] by the caller.  The channel must be buffered,
+// since the move is discarded if the caller isn't ready to receive it.
+func (g *EngineGame) Think(res chan<- EngineMove) {
+	if g.Termination != chego.Unterminated ||
+		g.Position.ActiveColor == g.playerColor {
+		return
+	}
+
+	fen := chego.SerializeFEN(g.Position)
+	ply := len(g.Played)
+	go func() {
+		// Restored games are abandoned if engine games have been disabled.
+		m, err := "", errNoEngine
+		if g.engine != nil {
+			m, err = g.engine.BestMove(fen, g.settings)
+		}
+		select {
+		case res <- EngineMove{Move: m, Ply: ply, Err: err}:
+		default:
+		}
+	}()
+}
+
+// PlayEngine performs the engine's move.  The move is discarded if the position
+// has changed since the search start, e.g. due to a takeback.
+func (g *EngineGame) PlayEngine(m EngineMove) (MovePayload, bool) {
+	if m.Ply != len(g.Played) || g.Position.ActiveColor == g.playerColor {
+		return MovePayload{}, false
+	}
+
+	index, ok := legalIndex(g.Game, m.Move)
+	if !ok {
+		log.Printf("engine sent illegal move %s in game %s", m.Move, g.id)
+		return MovePayload{}, false
+	}
+	return g.play(index)
+}
+
+func (g *EngineGame) play(index byte) (MovePayload, bool) {
+	if g.Termination != chego.Unterminated || index >= g.Legal.LastMoveIndex {
 		return MovePayload{}, false
 	}
 
@@ -74,6 +131,8 @@ func (g *EngineGame) Leave(id string) {
 	log.Printf("player %s leaves game %s", id, g.id)
 }
 
+func (g *EngineGame) IsPlayer(id string) bool { return id == g.playerId }
+
 func (g *EngineGame) TimeTick() {
 	if g.Termination != chego.Unterminated {
 		return
@@ -102,6 +161,29 @@ func (g *EngineGame) Resign(id string) bool {
 	return true
 }
 
+// Takeback undoes the player's last move along with the engine's reply if it was
+// already played.  The number of takebacks is unlimited in engine games.
+func (g *EngineGame) Takeback(id string) bool {
+	// Number of played moves including the player's first move.
+	firstMove := 1
+	if g.playerColor != position.ActiveColor(g.fen) {
+		firstMove = 2
+	}
+
+	if id != g.playerId || g.Termination != chego.Unterminated ||
+		len(g.playedIndices) < firstMove {
+		return false
+	}
+
+	n := 1
+	if g.Position.ActiveColor == g.playerColor {
+		n = 2
+	}
+	g.playedIndices = g.playedIndices[:len(g.playedIndices)-n]
+	g.Game = position.Replay(g.fen, g.playedIndices)
+	return true
+}
+
 func (g *EngineGame) Abandon() {
 	if g.Termination == chego.Unterminated {
 		g.Termination = chego.Abandoned
@@ -114,7 +196,7 @@ func (g *EngineGame) Abandon() {
 func (g *EngineGame) store() {
 	if err := g.gameRepo.UpdateEngine(db.EngineGameUpdate{
 		Id: g.id, Result: g.Result, Termination: g.Termination,
-		EncodedMoves: chego.HuffmanEncoding(g.playedIndices),
+		EncodedMoves: position.Encode(g.fen, g.playedIndices),
 		MovesLength:  len(g.Played),
 	}); err != nil {
 		log.Print(err)
@@ -122,6 +204,19 @@ func (g *EngineGame) store() {
 	}
 }
 
+// Checkpoint returns the state of the game required to restore it.
+func (g *EngineGame) Checkpoint() (db.Checkpoint, error) {
+	return newCheckpoint(g.id, db.EngineKind, engineState{
+		Indices:         g.playedIndices,
+		PlayerId:        g.playerId,
+		Settings:        g.settings,
+		FEN:             g.fen,
+		PlayerColor:     g.playerColor,
+		PlayerReconnect: g.playerReconnect,
+		IsPlayerOnline:  g.isPlayerOnline,
+	})
+}
+
 func (g *EngineGame) EndPayload() EndPayload {
 	return EndPayload{
 		Result:      g.Result,
@@ -133,5 +228,6 @@ func (g *EngineGame) GamePayload() GamePayload {
 	return GamePayload{
 		Legal:  g.Legal.Moves[:g.Legal.LastMoveIndex],
 		Played: g.Played,
+		FEN:    g.fen,
 	}
 }
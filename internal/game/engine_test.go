@@ -0,0 +1,175 @@
+package game
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+)
+
+// TestFakeEngine isn't a real test.  It's executed as a separate process by
+// startFakeEngine and acts as a scripted UCI engine which replies with the move
+// specified in the FAKE_ENGINE_MOVE environment variable.  The engine replies
+// only when asked to stop if the move is "stop" and never if it's "hang".
+func TestFakeEngine(t *testing.T) {
+	if os.Getenv("FAKE_ENGINE") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		cmd := in.Text()
+		switch {
+		case cmd == "uci":
+			fmt.Println("id name fake")
+			fmt.Println("uciok")
+		case cmd == "isready":
+			fmt.Println("readyok")
+		case strings.HasPrefix(cmd, "go"):
+			fmt.Println("info depth 1 score cp 20")
+			if m := os.Getenv("FAKE_ENGINE_MOVE"); m != "stop" && m != "hang" {
+				fmt.Println("bestmove " + m)
+			}
+		case cmd == "stop" && os.Getenv("FAKE_ENGINE_MOVE") == "stop":
+			fmt.Println("bestmove e2e4")
+		case cmd == "quit":
+			return
+		}
+	}
+}
+
+func startFakeEngine(t *testing.T, move string) *UCIEngine {
+	t.Setenv("FAKE_ENGINE", "1")
+	t.Setenv("FAKE_ENGINE_MOVE", move)
+
+	e, err := StartUCIEngine(os.Args[0], "-test.run=^TestFakeEngine$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestBestMove(t *testing.T) {
+	cases := []struct {
+		move     string
+		settings EngineSettings
+		expected string
+		isError  bool
+	}{
+		{"e2e4", engineSettings[db.Easy], "e2e4", false},
+		{"e7e8q", EngineSettings{Skill: 20, MoveTime: 2000}, "e7e8q", false},
+		{"(none)", engineSettings[db.Hard], "", true},
+	}
+
+	for i, tc := range cases {
+		e := startFakeEngine(t, tc.move)
+
+		got, err := e.BestMove(
+			"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", tc.settings,
+		)
+		if (err != nil) != tc.isError {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		if got != tc.expected {
+			t.Fatalf("case %d: expected: %s, got: %s", i, tc.expected, got)
+		}
+	}
+}
+
+func TestBestMoveTimeout(t *testing.T) {
+	grace := engineGrace
+	engineGrace = 100 * time.Millisecond
+	defer func() { engineGrace = grace }()
+
+	cases := []struct {
+		move     string
+		expected string
+		err      error
+	}{
+		// The engine ignores the search time, but obeys the stop command.
+		{"stop", "e2e4", nil},
+		{"hang", "", errEngineTimeout},
+	}
+
+	for i, tc := range cases {
+		e := startFakeEngine(t, tc.move)
+		pid := e.cmd.Process.Pid
+
+		// Hung engine is restarted after each search.
+		for range 2 {
+			got, err := e.BestMove(
+				"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+				EngineSettings{MoveTime: 10},
+			)
+			if got != tc.expected || !errors.Is(err, tc.err) {
+				t.Fatalf("case %d: expected: %s %v, got: %s %v", i, tc.expected, tc.err, got, err)
+			}
+		}
+		if isRestarted := e.cmd.Process.Pid != pid; isRestarted != (tc.err != nil) {
+			t.Fatalf("case %d: unexpected restart: %v", i, isRestarted)
+		}
+	}
+}
+
+func TestEnginePool(t *testing.T) {
+	grace, wait := engineGrace, engineWait
+	engineGrace, engineWait = 100*time.Millisecond, 50*time.Millisecond
+	defer func() { engineGrace, engineWait = grace, wait }()
+
+	t.Setenv("FAKE_ENGINE", "1")
+	t.Setenv("FAKE_ENGINE_MOVE", "hang")
+	p, err := StartEnginePool(2, os.Args[0], "-test.run=^TestFakeEngine$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	const fen = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+	// Both engines are busy with the hung searches.
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := p.BestMove(fen, EngineSettings{MoveTime: 10})
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err = p.BestMove(fen, EngineSettings{MoveTime: 10}); !errors.Is(err, errEngineBusy) {
+		t.Fatalf("expected: %v, got: %v", errEngineBusy, err)
+	}
+	for range 2 {
+		if err = <-errs; !errors.Is(err, errEngineTimeout) {
+			t.Fatalf("expected: %v, got: %v", errEngineTimeout, err)
+		}
+	}
+	// Engines are returned to the pool after the search.
+	if _, err = p.BestMove(fen, EngineSettings{MoveTime: 10}); !errors.Is(err, errEngineTimeout) {
+		t.Fatalf("expected: %v, got: %v", errEngineTimeout, err)
+	}
+}
+
+func TestSquareName(t *testing.T) {
+	cases := []struct {
+		square   int
+		expected string
+	}{
+		{0, "a1"},
+		{7, "h1"},
+		{28, "e4"},
+		{63, "h8"},
+	}
+
+	for i, tc := range cases {
+		if got := squareName(tc.square); got != tc.expected {
+			t.Fatalf("case %d: expected: %s, got: %s", i, tc.expected, got)
+		}
+	}
+}
@@ -1,7 +1,13 @@
 // Package game implements real time game management.
 package game
 
-import "github.com/treepeck/chego"
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/treepeck/chego"
+)
 
 const (
 	// Minimal number of moves required to terminate the game.
@@ -16,7 +22,9 @@ const (
 
 // Game methods are not safe for concurrent use.
 type Game interface {
-	Play(id string, index byte) (MovePayload, bool)
+	// Play performs the move with the specified index.  Latency is the sender's
+	// round-trip time in milliseconds used to compensate the spent time.
+	Play(id string, index byte, latency int) (MovePayload, bool)
 	// Resign handles player resignation.  Resignation will be discarded if one
 	// of the following is true:
 	//   - There were not enough moves played to end the game;
@@ -24,6 +32,9 @@ type Game interface {
 	//   - Sender is not white nor black player.
 	Join(id string)
 	Leave(id string)
+	// IsPlayer reports whether the id belongs to one of the players.  Other
+	// clients are spectators.
+	IsPlayer(id string) bool
 	TimeTick()
 	Resign(id string) bool
 	GamePayload() GamePayload
@@ -31,12 +42,129 @@ type Game interface {
 	Abandon()
 }
 
+// squareName returns the name of the square with the specified index, where
+// a1 is 0 and h8 is 63.
+func squareName(sq int) string {
+	return string([]byte{byte('a' + sq%8), byte('1' + sq/8)})
+}
+
+// legalIndex returns the index of the legal move specified in the UCI notation.
+func legalIndex(g chego.Game, uci string) (byte, bool) {
+	if len(uci) < 4 {
+		return 0, false
+	}
+
+	var i byte
+	for i = 0; i < g.Legal.LastMoveIndex; i++ {
+		m := g.Legal.Moves[i]
+		if squareName(m.From())+squareName(m.To()) != uci[:4] {
+			continue
+		}
+		if len(uci) == 4 {
+			return i, true
+		}
+
+		// Distinguish the promotion piece by the move's SAN, e.g. "e8=Q+".
+		if strings.Contains(playedSAN(g, i), "="+strings.ToUpper(uci[4:5])) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// playedSAN returns the SAN of the legal move with the specified index.  The
+// move is played on the copy of the game, so the game itself isn't modified.
+func playedSAN(g chego.Game, index byte) string {
+	g.Played = slices.Clone(g.Played)
+	g.Push(g.Legal.Moves[index])
+	return g.Played[len(g.Played)-1].San
+}
+
+// sanIndex returns the index of the legal move in the current position of the
+// game which has the specified SAN.  Check and annotation symbols are ignored.
+func sanIndex(g chego.Game, san string) (byte, bool) {
+	san = strings.TrimRight(san, "+#!?")
+
+	// Only the moves to the destination square are checked to avoid playing
+	// each legal move.  Castling moves are checked exhaustively.
+	dest := ""
+	if !strings.HasPrefix(san, "O-O") {
+		d, _, _ := strings.Cut(san, "=")
+		if len(d) < 2 {
+			return 0, false
+		}
+		dest = d[len(d)-2:]
+	}
+
+	var i byte
+	for i = 0; i < g.Legal.LastMoveIndex; i++ {
+		if len(dest) != 0 && squareName(g.Legal.Moves[i].To()) != dest {
+			continue
+		}
+		if strings.TrimRight(playedSAN(g, i), "+#") == san {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// decodeIndices reconstructs the indices of the Huffman-encoded moves.
+func decodeIndices(encoded []byte, length int) ([]byte, chego.Game, bool) {
+	g := chego.NewGame()
+	indices := make([]byte, 0, length)
+	for _, m := range chego.HuffmanDecoding(encoded, length) {
+		i, ok := sanIndex(g, m.San)
+		if !ok {
+			return nil, g, false
+		}
+		g.Push(g.Legal.Moves[i])
+		indices = append(indices, i)
+	}
+	return indices, g, true
+}
+
+// drawClaim validates the draw claim in the last of the specified positions.
+// Positions must contain the FEN of each position which has occurred in the game.
+func drawClaim(positions []string) (chego.Termination, bool) {
+	if len(positions) == 0 {
+		return chego.Unterminated, false
+	}
+
+	current := strings.Fields(positions[len(positions)-1])
+	if len(current) < 6 {
+		return chego.Unterminated, false
+	}
+
+	// Positions are the same if the piece placement, active color, castling
+	// rights and en passant target are the same.
+	key := strings.Join(current[:4], " ")
+	occurrences := 0
+	for _, fen := range positions {
+		if f := strings.Fields(fen); len(f) >= 4 && strings.Join(f[:4], " ") == key {
+			occurrences++
+		}
+	}
+	if occurrences >= 3 {
+		return chego.Repetition, true
+	}
+
+	// Halfmove clock counts plies since the last pawn move or capture.
+	if halfmoves, err := strconv.Atoi(current[4]); err == nil && halfmoves >= 100 {
+		return chego.FiftyMoves, true
+	}
+	return chego.Unterminated, false
+}
+
 type GamePayload struct {
 	Legal  []chego.Move       `json:"lm"`
 	Played []chego.PlayedMove `json:"m"`
-	// Clock values in seconds if present.
+	// FEN of the starting position.  Empty for the standard one.
+	FEN string `json:"f,omitempty"`
+	// Clock values in milliseconds if present.
 	WhiteTime int `json:"wt,omitempty"`
 	BlackTime int `json:"bt,omitempty"`
+	// Projected rating changes.  Present only in rated games.
+	Preview *RatingPreview `json:"rp,omitempty"`
 }
 
 type EndPayload struct {
@@ -46,7 +174,8 @@ type EndPayload struct {
 
 type MovePayload struct {
 	chego.PlayedMove
-	Legal    []chego.Move `json:"lm"`
-	Move     chego.Move   `json:"m"`
-	TimeLeft int          `json:"tl,omitempty"`
+	Legal []chego.Move `json:"lm"`
+	Move  chego.Move   `json:"m"`
+	// Time left of the player who has completed the move in milliseconds.
+	TimeLeft int `json:"tl,omitempty"`
 }
@@ -0,0 +1,36 @@
+package game
+
+import (
+	"testing"
+
+	"github.com/treepeck/chego"
+)
+
+func TestDrawClaim(t *testing.T) {
+	const (
+		start   = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+		knight  = "rnbqkbnr/pppppppp/8/8/8/5N2/PPPPPPPP/RNBQKB1R b KQkq - 1 1"
+		knights = "rnbqkb1r/pppppppp/5n2/8/8/5N2/PPPPPPPP/RNBQKB1R w KQkq - 2 2"
+		back    = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 4 3"
+		quiet   = "8/8/4k3/8/8/4K3/8/8 w - - 100 90"
+	)
+
+	cases := []struct {
+		positions []string
+		expected  chego.Termination
+		ok        bool
+	}{
+		{nil, chego.Unterminated, false},
+		{[]string{start}, chego.Unterminated, false},
+		{[]string{start, knight, knights, back}, chego.Unterminated, false},
+		{[]string{start, knight, knights, back, knight, knights, back}, chego.Repetition, true},
+		{[]string{quiet}, chego.FiftyMoves, true},
+	}
+
+	for i, tc := range cases {
+		got, ok := drawClaim(tc.positions)
+		if got != tc.expected || ok != tc.ok {
+			t.Fatalf("case %d: expected: %v %v, got: %v %v", i, tc.expected, tc.ok, got, ok)
+		}
+	}
+}
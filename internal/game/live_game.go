@@ -0,0 +1,518 @@
+package game
+
+import (
+	"justchess/internal/db"
+	"justchess/internal/position"
+	"log"
+
+	"github.com/treepeck/chego"
+)
+
+// liveGame implements the logic shared between the games of two players: clock,
+// resignations, draw offers, draw claims and takebacks.  Embedding types must
+// set the persistence hooks.
+type liveGame struct {
+	chego.Game
+
+	white   db.Player
+	black   db.Player
+	control db.TimeControl
+	// FEN of the starting position.  Empty for the standard one.
+	fen string
+	// Indices of played moves for Huffman coding.
+	playedIndices []byte
+	// FEN of each position which has occurred in the game.  Used to validate
+	// draw claims.
+	positions []string
+	// Changes of players' clocks in seconds after each played move.  Seconds
+	// are used instead of milliseconds for compression.
+	timeDiffs []int
+	// persist stores the terminated game.
+	persist func()
+	// markAbandoned marks the game with the specified id as abandoned.
+	markAbandoned  func(id string) error
+	drawIssuer     string
+	takebackIssuer string
+	rematchIssuer  string
+	// Moves in the UCI notation queued by players while it wasn't their turn.
+	whitePremove      string
+	blackPremove      string
+	id                string
+	clock             *clock
+	didWhiteOfferDraw bool
+	bidBlackOfferDraw bool
+	// Each player can offer a takeback only once per game.
+	didWhiteOfferTakeback bool
+	didBlackOfferTakeback bool
+	isWhiteOnline         bool
+	isBlackOnline         bool
+	// Only one rematch can be spawned from the game.
+	isRematched bool
+}
+
+func newLiveGame(id string, white, black db.Player, tc db.TimeControl,
+	fen string,
+) liveGame {
+	g := position.NewGame(fen)
+	return liveGame{
+		id:            id,
+		Game:          g,
+		positions:     []string{chego.SerializeFEN(g.Position)},
+		white:         white,
+		black:         black,
+		control:       tc,
+		fen:           fen,
+		playedIndices: make([]byte, 0),
+		timeDiffs:     make([]int, 0),
+		clock:         newClock(tc),
+	}
+}
+
+// Play performes the move with the specified index.  The time spent on the move
+// is reduced by the sender's network latency, specified in milliseconds.
+func (g *liveGame) Play(id string, index byte, latency int) (MovePayload, bool) {
+	if (g.Position.ActiveColor == chego.ColorWhite && id != g.white.Id) ||
+		(g.Position.ActiveColor == chego.ColorBlack && id != g.black.Id) {
+		return MovePayload{}, false
+	}
+	return g.move(index, latency)
+}
+
+// move performs the active player's move with the specified index.
+func (g *liveGame) move(index byte, latency int) (MovePayload, bool) {
+	if g.Termination != chego.Unterminated || index >= g.Legal.LastMoveIndex {
+		return MovePayload{}, false
+	}
+
+	mover := g.Position.ActiveColor
+	timeBefore := g.clock.whiteTime
+	if mover == chego.ColorBlack {
+		timeBefore = g.clock.blackTime
+	}
+
+	// The player has run out of time before the move was sent.
+	if g.clock.isFlagged(mover, latency) {
+		g.flag(mover)
+		return MovePayload{}, false
+	}
+
+	m := g.Legal.Moves[index]
+	g.Push(m)
+
+	// Store time after completing the move to synchronize clock on frontend.
+	timeLeft := g.clock.punch(mover, latency)
+
+	g.timeDiffs = append(g.timeDiffs, toSeconds(timeLeft)-toSeconds(timeBefore))
+	g.playedIndices = append(g.playedIndices, index)
+	g.positions = append(g.positions, chego.SerializeFEN(g.Position))
+	// The pending takeback offer refers to the previous position.
+	g.takebackIssuer = ""
+
+	if g.Termination != chego.Unterminated {
+		g.persist()
+	}
+
+	return MovePayload{
+		Legal:      g.Legal.Moves[:g.Legal.LastMoveIndex],
+		PlayedMove: g.Played[len(g.Played)-1],
+		TimeLeft:   timeLeft,
+		Move:       m,
+	}, true
+}
+
+// Premove queues the move specified in the UCI notation, e.g. "e2e4" or
+// "e7e8q".  The move is performed by [liveGame.PlayPremove] right after the
+// opponent's move.  Premove will be discarded if one of the following is true:
+//   - The game is already terminated;
+//   - Sender is not a white nor a black player;
+//   - It's the sender's turn;
+//   - The move is malformed.
+//
+// The previous premove of the sender is replaced.
+func (g *liveGame) Premove(id, uci string) bool {
+	if g.Termination != chego.Unterminated || (len(uci) != 4 && len(uci) != 5) {
+		return false
+	}
+
+	switch {
+	case id == g.white.Id && g.Position.ActiveColor == chego.ColorBlack:
+		g.whitePremove = uci
+	case id == g.black.Id && g.Position.ActiveColor == chego.ColorWhite:
+		g.blackPremove = uci
+	default:
+		return false
+	}
+	return true
+}
+
+func (g *liveGame) CancelPremove(id string) bool {
+	switch {
+	case id == g.white.Id && len(g.whitePremove) != 0:
+		g.whitePremove = ""
+	case id == g.black.Id && len(g.blackPremove) != 0:
+		g.blackPremove = ""
+	default:
+		return false
+	}
+	return true
+}
+
+// PlayPremove performs the active player's premove if it's legal in the current
+// position.  Since the turn has just started, the player is charged only for
+// the time spent by the server.  The premove is discarded either way.
+//
+// Returns the id of the player whose premove was pending or empty string.
+func (g *liveGame) PlayPremove() (MovePayload, string, bool) {
+	id, uci := g.white.Id, g.whitePremove
+	if g.Position.ActiveColor == chego.ColorBlack {
+		id, uci = g.black.Id, g.blackPremove
+	}
+	if len(uci) == 0 {
+		return MovePayload{}, "", false
+	}
+	g.whitePremove, g.blackPremove = "", ""
+
+	index, ok := legalIndex(g.Game, uci)
+	if !ok {
+		return MovePayload{}, id, false
+	}
+	p, ok := g.move(index, 0)
+	return p, id, ok
+}
+
+func (g *liveGame) Join(id string) {
+	switch id {
+	case g.white.Id:
+		g.isWhiteOnline = true
+	case g.black.Id:
+		g.isBlackOnline = true
+	}
+	log.Printf("player %s joins game %s", id, g.id)
+}
+
+func (g *liveGame) Leave(id string) {
+	switch id {
+	case g.white.Id:
+		g.isWhiteOnline = false
+	case g.black.Id:
+		g.isBlackOnline = false
+	}
+	log.Printf("player %s leaves game %s", id, g.id)
+}
+
+func (g *liveGame) IsPlayer(id string) bool {
+	return id == g.white.Id || id == g.black.Id
+}
+
+// TimeTick is called each second to detect time forfeits and decrement the
+// reconnect time of disconnected players.
+func (g *liveGame) TimeTick() {
+	if g.Termination != chego.Unterminated {
+		return
+	}
+
+	// If some player is disconnected, decrement their reconnect time.
+	if !g.isWhiteOnline {
+		g.clock.whiteReconnect--
+	}
+	if !g.isBlackOnline {
+		g.clock.blackReconnect--
+	}
+
+	active := g.Position.ActiveColor
+	switch {
+	// The move might be on its way, thus the active player is given the
+	// maximal lag compensation which the move would receive.
+	case g.clock.isFlagged(active, 2*maxLagCompensation):
+		g.flag(active)
+	case g.clock.whiteReconnect == 0:
+		g.flag(chego.ColorWhite)
+	case g.clock.blackReconnect == 0:
+		g.flag(chego.ColorBlack)
+	}
+}
+
+// flag terminates the game due to the time forfeit of the specified player.
+func (g *liveGame) flag(loser chego.Color) {
+	if g.IsInsufficientMaterial() {
+		// According to chess rules, the game is draw if opponent doesn't have
+		// sufficient material to checkmate you.
+		g.Terminate(chego.TimeForfeit, chego.Draw)
+	} else if len(g.Played) < minMoves {
+		// Mark game as abandoned if there was not enough moves played.
+		g.Abandon()
+		return
+	} else if loser == chego.ColorBlack {
+		g.Terminate(chego.TimeForfeit, chego.WhiteWon)
+	} else {
+		g.Terminate(chego.TimeForfeit, chego.BlackWon)
+	}
+	g.persist()
+}
+
+func (g *liveGame) Resign(id string) bool {
+	if len(g.Played) < minMoves || g.Termination != chego.Unterminated {
+		return false
+	}
+
+	switch id {
+	case g.white.Id:
+		g.Terminate(chego.Resignation, chego.BlackWon)
+	case g.black.Id:
+		g.Terminate(chego.Resignation, chego.WhiteWon)
+	}
+	g.persist()
+	return true
+}
+
+// OfferDraw handles draw offers. Offer will be discarded if one of the
+// following is true:
+//   - There were not enough moves played to terminate the game;
+//   - The game is already terminated;
+//   - Sender is not a white nor a black player;
+//   - One of the players has already sent a pending draw offer;
+//   - The player has sent a draw offer not so long ago.
+//
+// Returns empty string if offer was discarded and opponent id otherwise.
+func (g *liveGame) OfferDraw(id string) string {
+	if len(g.Played) < minMoves ||
+		g.Termination != chego.Unterminated ||
+		(id != g.white.Id && id != g.black.Id) ||
+		(id == g.white.Id && g.didWhiteOfferDraw) ||
+		(id == g.black.Id && g.bidBlackOfferDraw) ||
+		len(g.drawIssuer) != 0 {
+		return ""
+	}
+	g.drawIssuer = id
+
+	switch id {
+	case g.white.Id:
+		g.didWhiteOfferDraw = true
+		return g.black.Id
+	default:
+		g.bidBlackOfferDraw = true
+		return g.white.Id
+	}
+}
+
+func (g *liveGame) AcceptDraw(id string) bool {
+	if len(g.drawIssuer) == 0 ||
+		id == g.drawIssuer ||
+		(id != g.white.Id && id != g.black.Id) {
+		return false
+	}
+	g.drawIssuer = ""
+	g.Terminate(chego.Agreement, chego.Draw)
+	g.persist()
+	return true
+}
+
+func (g *liveGame) DeclineDraw(id string) bool {
+	if len(g.drawIssuer) == 0 ||
+		id == g.drawIssuer ||
+		(id != g.white.Id && id != g.black.Id) {
+		return false
+	}
+	g.drawIssuer = ""
+	return true
+}
+
+// ClaimDraw terminates the game as a draw if the current position has occurred
+// at least three times or the last fifty moves by each player were made without
+// pawn moves and captures.  Claim will be rejected if one of the following is
+// true:
+//   - The game is already terminated;
+//   - Sender is not the player to move;
+//   - Neither of the rules applies to the current position.
+func (g *liveGame) ClaimDraw(id string) bool {
+	if g.Termination != chego.Unterminated ||
+		(g.Position.ActiveColor == chego.ColorWhite && id != g.white.Id) ||
+		(g.Position.ActiveColor == chego.ColorBlack && id != g.black.Id) {
+		return false
+	}
+
+	t, ok := drawClaim(g.positions)
+	if !ok {
+		return false
+	}
+	g.Terminate(t, chego.Draw)
+	g.persist()
+	return true
+}
+
+// OfferTakeback handles takeback offers. Offer will be discarded if one of the
+// following is true:
+//   - The game is already terminated;
+//   - Sender is not a white nor a black player;
+//   - Sender hasn't played any move yet;
+//   - One of the players has already sent a pending takeback offer;
+//   - The player has already offered a takeback in this game.
+//
+// The offer is withdrawn once any move is played.  Returns empty string if
+// offer was discarded and opponent id otherwise.
+func (g *liveGame) OfferTakeback(id string) string {
+	if g.Termination != chego.Unterminated ||
+		(id != g.white.Id && id != g.black.Id) ||
+		(id == g.white.Id && (g.didWhiteOfferTakeback || g.clock.whiteMoves < 1)) ||
+		(id == g.black.Id && (g.didBlackOfferTakeback || g.clock.blackMoves < 1)) ||
+		len(g.takebackIssuer) != 0 {
+		return ""
+	}
+	g.takebackIssuer = id
+
+	switch id {
+	case g.white.Id:
+		g.didWhiteOfferTakeback = true
+		return g.black.Id
+	default:
+		g.didBlackOfferTakeback = true
+		return g.white.Id
+	}
+}
+
+// AcceptTakeback undoes the last move of the takeback issuer.  If the opponent
+// has already replied, their move is undone as well.
+func (g *liveGame) AcceptTakeback(id string) bool {
+	if len(g.takebackIssuer) == 0 ||
+		id == g.takebackIssuer ||
+		(id != g.white.Id && id != g.black.Id) ||
+		g.Termination != chego.Unterminated {
+		return false
+	}
+
+	issuer := chego.ColorWhite
+	if g.takebackIssuer == g.black.Id {
+		issuer = chego.ColorBlack
+	}
+	g.takebackIssuer = ""
+
+	n := 1
+	if g.Position.ActiveColor == issuer {
+		n = 2
+	}
+	g.takeback(n)
+	return true
+}
+
+func (g *liveGame) DeclineTakeback(id string) bool {
+	if len(g.takebackIssuer) == 0 ||
+		id == g.takebackIssuer ||
+		(id != g.white.Id && id != g.black.Id) {
+		return false
+	}
+	g.takebackIssuer = ""
+	return true
+}
+
+// takeback undoes n last played moves and restores the clock.
+func (g *liveGame) takeback(n int) {
+	n = min(n, len(g.playedIndices))
+	// The side which has made the first move.
+	first := position.ActiveColor(g.fen)
+	for i := len(g.playedIndices) - 1; i >= len(g.playedIndices)-n; i-- {
+		mover := first
+		if i%2 != 0 {
+			mover = 1 - first
+		}
+		g.clock.undo(mover)
+	}
+
+	g.playedIndices = g.playedIndices[:len(g.playedIndices)-n]
+	g.timeDiffs = g.timeDiffs[:len(g.timeDiffs)-n]
+	g.positions = g.positions[:len(g.positions)-n]
+	g.Game = position.Replay(g.fen, g.playedIndices)
+	// Premoves are discarded, since the position has changed.
+	g.whitePremove, g.blackPremove = "", ""
+}
+
+// Rematch describes the game requested by both players after the termination.
+type Rematch struct {
+	White   db.Player
+	Black   db.Player
+	Control db.TimeControl
+	// Starting position of the game.
+	FEN string
+}
+
+// OfferRematch handles rematch offers.  Offer will be discarded if one of the
+// following is true:
+//   - The game isn't terminated yet;
+//   - Sender is not a white nor a black player;
+//   - One of the players has already sent a pending rematch offer;
+//   - The rematch has already been accepted.
+//
+// Returns empty string if offer was discarded and opponent id otherwise.
+func (g *liveGame) OfferRematch(id string) string {
+	if g.Termination == chego.Unterminated ||
+		(id != g.white.Id && id != g.black.Id) ||
+		len(g.rematchIssuer) != 0 || g.isRematched {
+		return ""
+	}
+	g.rematchIssuer = id
+
+	if id == g.white.Id {
+		return g.black.Id
+	}
+	return g.white.Id
+}
+
+// AcceptRematch returns the rematch with swapped colors, the same time control
+// and the same starting position.  The rematch can be accepted only once.
+func (g *liveGame) AcceptRematch(id string) (Rematch, bool) {
+	if len(g.rematchIssuer) == 0 ||
+		id == g.rematchIssuer ||
+		(id != g.white.Id && id != g.black.Id) || g.isRematched {
+		return Rematch{}, false
+	}
+	g.rematchIssuer = ""
+	g.isRematched = true
+	return Rematch{
+		White: g.black, Black: g.white, Control: g.control, FEN: g.fen,
+	}, true
+}
+
+func (g *liveGame) DeclineRematch(id string) bool {
+	if len(g.rematchIssuer) == 0 ||
+		id == g.rematchIssuer ||
+		(id != g.white.Id && id != g.black.Id) {
+		return false
+	}
+	g.rematchIssuer = ""
+	return true
+}
+
+func (g *liveGame) Abandon() {
+	if g.Termination == chego.Unterminated {
+		g.Termination = chego.Abandoned
+		if err := g.markAbandoned(g.id); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (g *liveGame) GamePayload() GamePayload {
+	return GamePayload{
+		Legal:     g.Legal.Moves[:g.Legal.LastMoveIndex],
+		Played:    g.Played,
+		FEN:       g.fen,
+		WhiteTime: g.clock.timeLeft(chego.ColorWhite, g.Position.ActiveColor),
+		BlackTime: g.clock.timeLeft(chego.ColorBlack, g.Position.ActiveColor),
+	}
+}
+
+func (g *liveGame) EndPayload() EndPayload {
+	return EndPayload{
+		Termination: g.Termination,
+		Result:      g.Result,
+	}
+}
+
+// update returns the terminated game data to be stored in the repository.
+func (g *liveGame) update() db.RatedGameUpdate {
+	return db.RatedGameUpdate{
+		Id: g.id, Result: g.Result, Termination: g.Termination,
+		EncodedMoves:    position.Encode(g.fen, g.playedIndices),
+		CompressedDiffs: chego.CompressTimeDiffs(g.timeDiffs),
+		MovesLength:     len(g.Played),
+	}
+}
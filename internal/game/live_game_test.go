@@ -0,0 +1,204 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/chego"
+)
+
+func TestPremove(t *testing.T) {
+	cases := []struct {
+		id       string
+		uci      string
+		expected bool
+	}{
+		// White cannot premove on their own turn.
+		{"w", "e2e4", false},
+		{"b", "e7e5", true},
+		{"b", "e7e8q", true},
+		{"b", "e7", false},
+		{"spectator", "e7e5", false},
+	}
+
+	for i, tc := range cases {
+		g := newLiveGame("id", db.Player{Id: "w"}, db.Player{Id: "b"},
+			db.TimeControl{Control: 60}, "")
+
+		if got := g.Premove(tc.id, tc.uci); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+		if got := g.CancelPremove(tc.id); got != tc.expected {
+			t.Fatalf("case %d: cancel: expected: %v, got: %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestRematch(t *testing.T) {
+	cases := []struct {
+		offerId      string
+		acceptId     string
+		isTerminated bool
+		expected     bool
+	}{
+		// Rematch is offered only after the termination.
+		{"w", "b", false, false},
+		{"w", "b", true, true},
+		{"b", "w", true, true},
+		{"w", "w", true, false},
+		{"spectator", "b", true, false},
+	}
+
+	for i, tc := range cases {
+		w, b := db.Player{Id: "w"}, db.Player{Id: "b"}
+		tcontrol := db.TimeControl{Control: 180, Bonus: 2}
+		g := newLiveGame("id", w, b, tcontrol, "")
+		if tc.isTerminated {
+			g.Termination = chego.Resignation
+		}
+
+		g.OfferRematch(tc.offerId)
+		m, ok := g.AcceptRematch(tc.acceptId)
+		if ok != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, ok)
+		}
+		if ok && (m.White != b || m.Black != w || m.Control.Bonus != tcontrol.Bonus) {
+			t.Fatalf("case %d: colors aren't swapped: %v", i, m)
+		}
+		if !ok {
+			continue
+		}
+
+		// Only one rematch is spawned from the game.
+		if len(g.OfferRematch(tc.acceptId)) != 0 {
+			t.Fatalf("case %d: offer after the rematch is accepted", i)
+		}
+		g.rematchIssuer = tc.offerId
+		if _, ok = g.AcceptRematch(tc.acceptId); ok {
+			t.Fatalf("case %d: rematch is accepted twice", i)
+		}
+	}
+}
+
+func TestTakeback(t *testing.T) {
+	cases := []struct {
+		// Number of moves played before the offer.
+		before int
+		// Number of moves played after the offer.
+		after    int
+		offerId  string
+		acceptId string
+		expected int
+		ok       bool
+		// Clock and the side to move after the takeback.
+		whiteTime int
+		blackTime int
+		active    chego.Color
+	}{
+		// The opponent hasn't replied yet, thus only the issuer's move is undone.
+		{1, 0, "w", "b", 0, true, 60000, 60000, chego.ColorWhite},
+		// The opponent has already replied.
+		{2, 0, "w", "b", 0, true, 60000, 60000, chego.ColorWhite},
+		{2, 0, "b", "w", 1, true, 59000, 60000, chego.ColorBlack},
+		// Stale offer cannot be accepted after the position has changed.
+		{1, 1, "w", "b", 2, false, 59000, 59000, chego.ColorWhite},
+		{2, 1, "b", "w", 3, false, 58000, 59000, chego.ColorBlack},
+		{1, 0, "w", "w", 1, false, 59000, 60000, chego.ColorBlack},
+	}
+
+	for i, tc := range cases {
+		g := newLiveGame("id", db.Player{Id: "w"}, db.Player{Id: "b"},
+			db.TimeControl{Control: 60}, "")
+		g.persist = func() {}
+		// Each move takes a second.
+		play := func() {
+			g.clock.turnStart = ago(1000)
+			g.move(0, 0)
+		}
+		for range tc.before {
+			play()
+		}
+		if len(g.OfferTakeback(tc.offerId)) == 0 {
+			t.Fatalf("case %d: offer is discarded", i)
+		}
+		for range tc.after {
+			play()
+		}
+
+		if ok := g.AcceptTakeback(tc.acceptId); ok != tc.ok {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.ok, ok)
+		}
+		if len(g.playedIndices) != tc.expected || len(g.timeDiffs) != tc.expected {
+			t.Fatalf("case %d: expected: %d, got: %d %d", i, tc.expected,
+				len(g.playedIndices), len(g.timeDiffs))
+		}
+		if !isNear(g.clock.whiteTime, tc.whiteTime) || !isNear(g.clock.blackTime, tc.blackTime) {
+			t.Fatalf("case %d: expected: %d %d, got: %d %d", i, tc.whiteTime,
+				tc.blackTime, g.clock.whiteTime, g.clock.blackTime)
+		}
+		if g.Position.ActiveColor != tc.active {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.active, g.Position.ActiveColor)
+		}
+	}
+}
+
+func TestClaimDraw(t *testing.T) {
+	const quiet = "8/8/4k3/8/8/4K3/8/8 w - - 100 90"
+
+	cases := []struct {
+		id       string
+		active   chego.Color
+		expected bool
+	}{
+		{"w", chego.ColorWhite, true},
+		{"b", chego.ColorBlack, true},
+		// Only the player to move can claim a draw.
+		{"b", chego.ColorWhite, false},
+		{"w", chego.ColorBlack, false},
+		{"spectator", chego.ColorWhite, false},
+	}
+
+	for i, tc := range cases {
+		g := newLiveGame("id", db.Player{Id: "w"}, db.Player{Id: "b"},
+			db.TimeControl{Control: 60}, "")
+		g.persist = func() {}
+		g.Position.ActiveColor = tc.active
+		g.positions = []string{quiet}
+
+		if got := g.ClaimDraw(tc.id); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+		if tc.expected && g.Termination != chego.FiftyMoves {
+			t.Fatalf("case %d: expected: %v, got: %v", i, chego.FiftyMoves, g.Termination)
+		}
+	}
+}
+
+func TestTimeTick(t *testing.T) {
+	cases := []struct {
+		// Milliseconds spent by the active player.
+		spent    int
+		expected chego.Termination
+	}{
+		{900, chego.Unterminated},
+		// The move which would be compensated might be on its way.
+		{1000 + maxLagCompensation/2, chego.Unterminated},
+		{1000 + 2*maxLagCompensation, chego.Abandoned},
+	}
+
+	for i, tc := range cases {
+		g := newLiveGame("id", db.Player{Id: "w"}, db.Player{Id: "b"},
+			db.TimeControl{Control: 1}, "")
+		g.persist = func() {}
+		g.markAbandoned = func(string) error { return nil }
+		g.isWhiteOnline, g.isBlackOnline = true, true
+		g.clock.turnStart = time.Now().Add(-time.Duration(tc.spent) * time.Millisecond)
+
+		g.TimeTick()
+		if g.Termination != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, g.Termination)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"justchess/internal/db"
+	"justchess/internal/position"
+
+	"github.com/treepeck/chego"
+)
+
+// ErrTooManyGames is returned by [ParsePGN] when the PGN contains more games
+// than allowed.
+var ErrTooManyGames = errors.New("game: PGN contains too many games")
+
+var (
+	errNoGames = errors.New("game: PGN doesn't contain games")
+	// Errors of the single game are wrapped by [ParsePGN].
+	errSetUp        = errors.New("custom starting positions aren't supported")
+	errMalformedTag = errors.New("malformed tag")
+)
+
+const (
+	// Origin of the games used in the Site tag.
+	pgnSite = "https://justchess.org"
+	// Maximal length of the movetext line.
+	pgnLineLength = 80
+)
+
+// pgnTag is a single PGN tag pair.
+type pgnTag struct {
+	name  string
+	value string
+}
+
+// WriteRatedPGN writes the rated or casual game in PGN.  The clock comments are
+// rebuilt from the time differences of the moves.
+func WriteRatedPGN(w io.Writer, g db.RatedGame, isCasual bool) error {
+	event, path := "Rated game", "/rated/"
+	if isCasual {
+		event, path = "Casual game", "/casual/"
+	}
+
+	tags := []pgnTag{
+		{"Event", event},
+		{"Site", pgnSite + path + g.Id},
+		{"Date", g.CreatedAt.Format("2006.01.02")},
+		{"Round", "-"},
+		{"White", g.White.Name},
+		{"Black", g.Black.Name},
+		{"Result", pgnResult(g.Result)},
+		{"WhiteElo", strconv.Itoa(int(g.White.Rating + 0.5))},
+		{"BlackElo", strconv.Itoa(int(g.Black.Rating + 0.5))},
+		{"TimeControl", pgnTimeControl(db.TimeControl{
+			Stages: g.Stages, Control: g.Control, Bonus: g.Bonus,
+		})},
+		{"Termination", pgnTermination(g.Termination)},
+	}
+
+	var clocks []string
+	if len(g.TimeDiffs) == len(g.Moves) {
+		clocks = pgnClocks(g.Control, position.ActiveColor(g.FEN), g.TimeDiffs)
+	}
+	return writePGN(w, tags, g.FEN, g.Moves, clocks, g.Result)
+}
+
+// WriteEnginePGN writes the game played vs engine in PGN.
+func WriteEnginePGN(w io.Writer, g db.EngineGame) error {
+	white, black := g.Player.Name, "Engine"
+	if g.PlayerColor == chego.ColorBlack {
+		white, black = black, white
+	}
+
+	tags := []pgnTag{
+		{"Event", "Engine game"},
+		{"Site", pgnSite + "/engine/" + g.Id},
+		{"Date", g.CreatedAt.Format("2006.01.02")},
+		{"Round", "-"},
+		{"White", white},
+		{"Black", black},
+		{"Result", pgnResult(g.Result)},
+		// Games vs engine are untimed.
+		{"TimeControl", "-"},
+		{"Termination", pgnTermination(g.Termination)},
+	}
+	return writePGN(w, tags, g.FEN, g.Moves, nil, g.Result)
+}
+
+// writePGN writes the tag pairs followed by the movetext.  The SetUp and FEN
+// tags are added if the game starts from the custom position.  Clock comments
+// are omitted if clocks is nil.
+func writePGN(w io.Writer, tags []pgnTag, fen string, moves []chego.PlayedMove,
+	clocks []string, r chego.Result,
+) error {
+	// Ply of the first move, which is odd if black moves first.
+	first := 0
+	if len(fen) != 0 {
+		tags = append(tags, pgnTag{"SetUp", "1"}, pgnTag{"FEN", fen})
+		fields := strings.Fields(fen)
+		if n, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+			first = 2 * (n - 1)
+		}
+		if position.ActiveColor(fen) == chego.ColorBlack {
+			first++
+		}
+	}
+
+	var b strings.Builder
+	for _, t := range tags {
+		fmt.Fprintf(&b, "[%s \"%s\"]\n", t.name, pgnEscape(t.value))
+	}
+	b.WriteByte('\n')
+
+	tokens := make([]string, 0, 2*len(moves)+2)
+	for i, m := range moves {
+		ply := first + i
+		if ply%2 == 0 {
+			tokens = append(tokens, strconv.Itoa(ply/2+1)+".")
+		} else if i == 0 {
+			tokens = append(tokens, strconv.Itoa(ply/2+1)+"...")
+		}
+		tokens = append(tokens, m.San)
+		if clocks != nil {
+			tokens = append(tokens, "{[%clk "+clocks[i]+"]}")
+		}
+	}
+	tokens = append(tokens, pgnResult(r))
+
+	// Tokens are wrapped to keep the lines short.
+	length := 0
+	for i, t := range tokens {
+		if i > 0 && length+1+len(t) > pgnLineLength {
+			b.WriteByte('\n')
+			length = 0
+		} else if i > 0 {
+			b.WriteByte(' ')
+			length++
+		}
+		b.WriteString(t)
+		length += len(t)
+	}
+	b.WriteString("\n\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// pgnClocks returns the remaining time of the player after each move in the
+// H:MM:SS format.  First is the side which has made the first move.  Diffs are
+// specified in seconds.
+func pgnClocks(control int, first chego.Color, diffs []int) []string {
+	clocks := make([]string, len(diffs))
+	remaining := [2]int{control, control}
+	for i, d := range diffs {
+		mover := (int(first) + i) % 2
+		remaining[mover] += d
+		s := max(remaining[mover], 0)
+		clocks[i] = fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return clocks
+}
+
+// pgnTimeControl formats the time control according to the PGN specification,
+// e.g. "40/5400+30:1800+30" for the single stage control.  The way the bonus is
+// applied cannot be specified.
+func pgnTimeControl(tc db.TimeControl) string {
+	period := func(seconds int) string {
+		if tc.Bonus == 0 {
+			return strconv.Itoa(seconds)
+		}
+		return fmt.Sprintf("%d+%d", seconds, tc.Bonus)
+	}
+
+	periods := make([]string, 0, len(tc.Stages)+1)
+	moves, seconds := 0, tc.Control
+	for _, s := range tc.Stages {
+		periods = append(periods, fmt.Sprintf("%d/%s", s.Move-moves, period(seconds)))
+		moves, seconds = s.Move, s.Time
+	}
+	return strings.Join(append(periods, period(seconds)), ":")
+}
+
+func pgnResult(r chego.Result) string {
+	switch r {
+	case chego.WhiteWon:
+		return "1-0"
+	case chego.BlackWon:
+		return "0-1"
+	case chego.Draw:
+		return "1/2-1/2"
+	}
+	return "*"
+}
+
+func pgnTermination(t chego.Termination) string {
+	switch t {
+	case chego.Unterminated:
+		return "unterminated"
+	case chego.Abandoned:
+		return "abandoned"
+	case chego.TimeForfeit:
+		return "time forfeit"
+	}
+	return "normal"
+}
+
+// pgnEscape escapes quotes and backslashes in the tag value.
+func pgnEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// ParsePGN parses the games from PGN and validates their moves.  Comments,
+// variations and annotations are skipped.  Returns the error which specifies
+// the number of the malformed game if any.  Parsing stops as soon as the game
+// beyond the limit is found.  Returned games must be assigned ids and the player
+// before they are stored.
+func ParsePGN(pgn string, limit int) ([]db.ImportedGame, error) {
+	p := pgnParser{input: pgn}
+	games := make([]db.ImportedGame, 0, 1)
+	for {
+		g, ok, err := p.game()
+		if err != nil {
+			return nil, fmt.Errorf("game: PGN game %d: %w", len(games)+1, err)
+		}
+		if !ok {
+			break
+		}
+		if len(games) == limit {
+			return nil, ErrTooManyGames
+		}
+		games = append(games, g)
+	}
+
+	if len(games) == 0 {
+		return nil, errNoGames
+	}
+	return games, nil
+}
+
+// pgnParser reads the games from PGN one by one.
+type pgnParser struct {
+	input string
+	pos   int
+}
+
+// game parses the next game.  Returns false if there are no games left.
+func (p *pgnParser) game() (db.ImportedGame, bool, error) {
+	ig := db.ImportedGame{Headers: make(db.Headers, 0, 10)}
+	g := chego.NewGame()
+	indices := make([]byte, 0, 80)
+	isEmpty := true
+
+	for {
+		p.skipSpace()
+		// The game without the termination marker ends with the input or the
+		// tags of the next game.
+		if p.pos >= len(p.input) || (p.input[p.pos] == '[' && len(indices) > 0) {
+			break
+		}
+
+		switch p.input[p.pos] {
+		case '[':
+			h, err := p.tag()
+			if err != nil {
+				return ig, false, err
+			}
+			if h.Name == "FEN" || (h.Name == "SetUp" && h.Value == "1") {
+				return ig, false, errSetUp
+			}
+			ig.Headers = append(ig.Headers, h)
+			switch h.Name {
+			case "White":
+				ig.White = h.Value
+			case "Black":
+				ig.Black = h.Value
+			}
+
+		case '{':
+			p.skipUntil('}')
+		case ';', '%':
+			p.skipUntil('\n')
+		case '(':
+			p.skipVariation()
+
+		default:
+			t := p.token()
+			if r, ok := parseResult(t); ok {
+				ig.Result = r
+				return encodeImported(ig, indices), true, nil
+			}
+
+			san := t
+			// Castling is sometimes written with zeros.
+			if strings.HasPrefix(san, "0-0") {
+				san = strings.ReplaceAll(san, "0", "O")
+			}
+			// Skip move numbers and numeric annotation glyphs.
+			san = strings.TrimLeft(san, "0123456789.")
+			if len(san) == 0 || san[0] == '$' {
+				break
+			}
+
+			i, ok := sanIndex(g, san)
+			if !ok {
+				return ig, false, fmt.Errorf("illegal move %q", t)
+			}
+			g.Push(g.Legal.Moves[i])
+			indices = append(indices, i)
+			ig.Moves = append(ig.Moves, g.Played[len(g.Played)-1])
+		}
+		isEmpty = false
+	}
+	return encodeImported(ig, indices), !isEmpty, nil
+}
+
+// encodeImported stores the moves of the game in the same format as other games.
+func encodeImported(ig db.ImportedGame, indices []byte) db.ImportedGame {
+	ig.Encoded = chego.HuffmanEncoding(indices)
+	ig.MovesLength = len(indices)
+	return ig
+}
+
+// tag parses the tag pair, e.g. [White "Name"].  The value may contain escaped
+// quotes and backslashes.
+func (p *pgnParser) tag() (db.Header, error) {
+	// Skip the opening bracket.
+	p.pos++
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && !unicode.IsSpace(rune(p.input[p.pos])) &&
+		p.input[p.pos] != '"' && p.input[p.pos] != ']' {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+
+	p.skipSpace()
+	if len(name) == 0 || p.pos >= len(p.input) || p.input[p.pos] != '"' {
+		return db.Header{}, errMalformedTag
+	}
+
+	var value strings.Builder
+	for p.pos++; p.pos < len(p.input) && p.input[p.pos] != '"'; p.pos++ {
+		if p.input[p.pos] == '\\' && p.pos+1 < len(p.input) {
+			p.pos++
+		}
+		value.WriteByte(p.input[p.pos])
+	}
+	// Skip the closing quote.
+	p.pos++
+
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != ']' {
+		return db.Header{}, errMalformedTag
+	}
+	p.pos++
+	return db.Header{Name: name, Value: value.String()}, nil
+}
+
+// token reads the movetext token until the space or the special character.
+func (p *pgnParser) token() string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := rune(p.input[p.pos])
+		if unicode.IsSpace(c) || strings.ContainsRune("[]{}();", c) {
+			break
+		}
+		p.pos++
+	}
+	// The special character which doesn't start anything is skipped.
+	if p.pos == start {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *pgnParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// skipUntil skips the input up to and including the specified character.
+func (p *pgnParser) skipUntil(c byte) {
+	if i := strings.IndexByte(p.input[p.pos:], c); i != -1 {
+		p.pos += i + 1
+		return
+	}
+	p.pos = len(p.input)
+}
+
+// skipVariation skips the variation including the nested ones and comments.
+func (p *pgnParser) skipVariation() {
+	depth := 0
+	for p.pos < len(p.input) {
+		switch p.input[p.pos] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '{':
+			p.skipUntil('}')
+			continue
+		}
+		p.pos++
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+func parseResult(t string) (chego.Result, bool) {
+	switch t {
+	case "1-0":
+		return chego.WhiteWon, true
+	case "0-1":
+		return chego.BlackWon, true
+	case "1/2-1/2":
+		return chego.Draw, true
+	case "*":
+		return chego.Unknown, true
+	}
+	return chego.Unknown, false
+}
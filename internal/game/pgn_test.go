@@ -0,0 +1,120 @@
+package game
+
+import (
+	"strings"
+	"testing"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/chego"
+)
+
+func TestPGNTimeControl(t *testing.T) {
+	cases := []struct {
+		tc       db.TimeControl
+		expected string
+	}{
+		{db.TimeControl{Control: 300}, "300"},
+		{db.TimeControl{Control: 180, Bonus: 2}, "180+2"},
+		{
+			db.TimeControl{Control: 5400, Bonus: 30, Stages: db.Stages{{Move: 40, Time: 1800}}},
+			"40/5400+30:1800+30",
+		},
+		{
+			db.TimeControl{Control: 7200, Stages: db.Stages{{Move: 40, Time: 3600}, {Move: 60, Time: 900}}},
+			"40/7200:20/3600:900",
+		},
+	}
+
+	for i, tc := range cases {
+		if got := pgnTimeControl(tc.tc); got != tc.expected {
+			t.Fatalf("case %d: expected: %s, got: %s", i, tc.expected, got)
+		}
+	}
+}
+
+func TestPGNClocks(t *testing.T) {
+	cases := []struct {
+		first    chego.Color
+		diffs    []int
+		expected []string
+	}{
+		{chego.ColorWhite, []int{-1, 2, -3601, -61},
+			[]string{"0:59:59", "1:00:02", "0:00:00", "0:59:01"}},
+		// Black moves first in the custom position.
+		{chego.ColorBlack, []int{-1, -10, -1},
+			[]string{"0:59:59", "0:59:50", "0:59:58"}},
+	}
+
+	for i, tc := range cases {
+		got := pgnClocks(3600, tc.first, tc.diffs)
+		for j := range tc.expected {
+			if got[j] != tc.expected[j] {
+				t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+			}
+		}
+	}
+}
+
+func TestWritePGN(t *testing.T) {
+	const endgame = "8/8/4k3/8/8/4K3/4P3/8 b - - 0 40"
+	moves := []chego.PlayedMove{{San: "e4"}, {San: "e5"}, {San: "Qh5"}}
+	cases := []struct {
+		fen      string
+		clocks   []string
+		expected string
+	}{
+		{"", []string{"0:05:00", "0:04:59", "0:04:58"}, "[White \"A \\\"B\\\"\"]\n\n" +
+			"1. e4 {[%clk 0:05:00]} e5 {[%clk 0:04:59]} 2. Qh5 {[%clk 0:04:58]} *\n\n"},
+		// Black moves first in the custom position.
+		{endgame, nil, "[White \"A \\\"B\\\"\"]\n[SetUp \"1\"]\n[FEN \"" + endgame +
+			"\"]\n\n40... e4 41. e5 Qh5 *\n\n"},
+	}
+
+	for i, tc := range cases {
+		var b strings.Builder
+		err := writePGN(&b, []pgnTag{{"White", `A "B"`}}, tc.fen, moves,
+			tc.clocks, chego.Unknown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tc.expected {
+			t.Fatalf("case %d: expected: %q, got: %q", i, tc.expected, b.String())
+		}
+	}
+}
+
+func TestParsePGN(t *testing.T) {
+	cases := []struct {
+		pgn    string
+		white  string
+		result chego.Result
+		games  int
+		isErr  bool
+	}{
+		{"[White \"A \\\"B\\\"\"]\n[Black \"C\"]\n\n*\n", `A "B"`, chego.Unknown, 1, false},
+		{"[White \"A\"]\n\n1-0\n\n[White \"B\"]\n{1. e4} (1. d4 (1. c4)) ; e4\n0-1",
+			"A", chego.WhiteWon, 2, false},
+		{"[White \"A\"]\n\n1/2-1/2", "A", chego.Draw, 1, false},
+		{"", "", 0, 0, true},
+		{"[White \"A\"", "", 0, 0, true},
+		{"[FEN \"8/8/4k3/8/8/4K3/8/8 w - - 0 1\"]\n\n*", "", 0, 0, true},
+		{"1. Ke9 *", "", 0, 0, true},
+		// Games beyond the limit.
+		{"*\n\n*\n\n*", "", 0, 0, true},
+	}
+
+	for i, tc := range cases {
+		games, err := ParsePGN(tc.pgn, 2)
+		if (err != nil) != tc.isErr {
+			t.Fatalf("case %d: expected error: %v, got: %v", i, tc.isErr, err)
+		}
+		if len(games) != tc.games {
+			t.Fatalf("case %d: expected: %d games, got: %d", i, tc.games, len(games))
+		}
+		if tc.games > 0 && (games[0].White != tc.white || games[0].Result != tc.result) {
+			t.Fatalf("case %d: expected: %s %d, got: %s %d", i, tc.white,
+				tc.result, games[0].White, games[0].Result)
+		}
+	}
+}
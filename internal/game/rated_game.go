@@ -14,333 +14,177 @@ const (
 	minDeviation = 30
 	minSigma     = 0.04
 	maxSigma     = 0.08
+	// Ratings with the higher deviation are provisional.
+	provisionalDeviation = 110
 )
 
+// RatingParams are the bounds and the system constant of the Glicko-2 rating
+// estimation.
+type RatingParams struct {
+	MinRating    float64
+	MaxRating    float64
+	MinDeviation float64
+	MinSigma     float64
+	MaxSigma     float64
+	Tau          float64
+}
+
+// DefaultRatingParams are used to rate the games.
+var DefaultRatingParams = RatingParams{
+	MinRating:    minRating,
+	MaxRating:    maxRating,
+	MinDeviation: minDeviation,
+	MinSigma:     minSigma,
+	MaxSigma:     maxSigma,
+	Tau:          glicko.DefaultTau,
+}
+
 type RatedGame struct {
-	chego.Game
+	liveGame
 
-	white db.Player
-	black db.Player
-	// Indices of played moves for Huffman coding.
-	playedIndices []byte
-	// Amount of seconds players spent on played moves. For compression.
-	timeDiffs         []int
-	gameRepo          db.GameRepo
-	playerRepo        db.PlayerRepo
-	drawIssuer        string
-	id                string
-	clock             *clock
-	didWhiteOfferDraw bool
-	bidBlackOfferDraw bool
-	isWhiteOnline     bool
-	isBlackOnline     bool
+	gameRepo db.GameRepo
 }
 
 // SpawnRatedGame inserts a new rated game record into repository and initializes
-// [RatedGame] fields.
+// [RatedGame] fields.  Players are selected again with their ratings in the
+// category of the time control.  The game starts from the position specified by
+// FEN, which must be validated beforehand, or from the standard one if it's
+// empty.
 func SpawnRatedGame(
-	white, black db.Player, control, bonus int,
+	white, black db.Player, tc db.TimeControl, fen string,
 	id string, gr db.GameRepo, pr db.PlayerRepo,
 ) (*RatedGame, error) {
-	if err := gr.InsertRated(id, white.Id, black.Id, control, bonus); err != nil {
+	var err error
+	if white, err = pr.SelectById(white.Id, tc.Category()); err != nil {
 		return nil, err
 	}
-	return &RatedGame{
-		id:            id,
-		Game:          chego.NewGame(),
-		white:         white,
-		black:         black,
-		gameRepo:      gr,
-		playerRepo:    pr,
-		playedIndices: make([]byte, 0),
-		timeDiffs:     make([]int, 0),
-		clock:         newClock(control, bonus),
-	}, nil
-}
-
-// Play performes the move with the specified index.
-func (g *RatedGame) Play(id string, index byte) (MovePayload, bool) {
-	if (len(g.Played)%2 == 0 && id != g.white.Id) ||
-		(len(g.Played)%2 != 0 && id != g.black.Id) ||
-		g.Termination != chego.Unterminated ||
-		index >= g.Legal.LastMoveIndex {
-		return MovePayload{}, false
-	}
-
-	m := g.Legal.Moves[index]
-	g.Push(m)
-
-	// Store time after completing the move to synchronize clock on frontend.
-	var timeDiff, timeLeft int
-	if g.Position.ActiveColor == chego.ColorWhite {
-		g.clock.blackTime += g.clock.bonus
-		timeDiff = g.clock.blackTime - g.clock.timeBeforeMove
-		g.clock.timeBeforeMove = g.clock.whiteTime
-		timeLeft = g.clock.blackTime
-	} else {
-		g.clock.whiteTime += g.clock.bonus
-		timeDiff = g.clock.whiteTime - g.clock.timeBeforeMove
-		g.clock.timeBeforeMove = g.clock.blackTime
-		timeLeft = g.clock.whiteTime
+	if black, err = pr.SelectById(black.Id, tc.Category()); err != nil {
+		return nil, err
 	}
 
-	g.timeDiffs = append(g.timeDiffs, timeDiff)
-	g.playedIndices = append(g.playedIndices, index)
-
-	if g.Termination != chego.Unterminated {
-		g.store()
+	if err = gr.InsertRated(id, white.Id, black.Id, tc, fen); err != nil {
+		return nil, err
 	}
-
-	return MovePayload{
-		Legal:      g.Legal.Moves[:g.Legal.LastMoveIndex],
-		PlayedMove: g.Played[len(g.Played)-1],
-		TimeLeft:   timeLeft,
-		Move:       m,
-	}, true
+	return newRatedGame(newLiveGame(id, white, black, tc, fen), gr), nil
 }
 
-func (g *RatedGame) Join(id string) {
-	switch id {
-	case g.white.Id:
-		g.isWhiteOnline = true
-	case g.black.Id:
-		g.isBlackOnline = true
-	}
-	log.Printf("player %s joins game %s", id, g.id)
+func newRatedGame(lg liveGame, gr db.GameRepo) *RatedGame {
+	g := &RatedGame{liveGame: lg, gameRepo: gr}
+	g.persist = g.store
+	g.markAbandoned = gr.MarkRatedAsAbandoned
+	return g
 }
 
-func (g *RatedGame) Leave(id string) {
-	switch id {
-	case g.white.Id:
-		g.isWhiteOnline = false
-	case g.black.Id:
-		g.isBlackOnline = false
-	}
-	log.Printf("player %s leaves game %s", id, g.id)
+// Checkpoint returns the state of the game required to restore it.
+func (g *RatedGame) Checkpoint() (db.Checkpoint, error) {
+	return newCheckpoint(g.id, db.RatedKind, g.state())
 }
 
-// TimeTick decrements player's time each second. It's the caller's responsibility
-// to ensure this function called only when the game is not terminated.
-func (g *RatedGame) TimeTick() {
-	if g.Termination != chego.Unterminated {
-		return
-	}
-
-	// If some player is disconnected, decrement their reconnect time.
-	if !g.isWhiteOnline {
-		g.clock.whiteReconnect--
-	}
-	if !g.isBlackOnline {
-		g.clock.blackReconnect--
-	}
-
-	// Decrement player's time.
-	if g.Position.ActiveColor == chego.ColorWhite {
-		g.clock.whiteTime--
-	} else {
-		g.clock.blackTime--
-	}
-
-	// Terminate the game due to the time forfeit.
-	if g.clock.whiteTime == 0 || g.clock.blackTime == 0 ||
-		g.clock.whiteReconnect == 0 || g.clock.blackReconnect == 0 {
-		if g.IsInsufficientMaterial() {
-			// According to chess rules, the game is draw if opponent doesn't have
-			// sufficient material to checkmate you.
-			g.Terminate(chego.TimeForfeit, chego.Draw)
-		} else if len(g.Played) < minMoves {
-			// Mark game as abandoned if there was not enough moves played.
-			g.Abandon()
-			return
-		} else {
-			if g.clock.blackTime == 0 || g.clock.blackReconnect == 0 {
-				g.Terminate(chego.TimeForfeit, chego.WhiteWon)
-			} else {
-				g.Terminate(chego.TimeForfeit, chego.BlackWon)
-			}
-		}
-	}
-
-	if g.Termination != chego.Unterminated {
-		g.store()
+// store stores the terminated game and updates the players' ratings.  Ratings
+// are estimated from the current ratings of the players instead of the ones
+// they had at the start of the game, since players might have completed other
+// games meanwhile.
+func (g *RatedGame) store() {
+	err := g.gameRepo.FinalizeRated(
+		g.update(), g.control.Category(), g.white.Id, g.black.Id, g.ratings,
+	)
+	if err != nil {
+		log.Print(err)
 	}
 }
 
-func (g *RatedGame) Resign(id string) bool {
-	if len(g.Played) < minMoves || g.Termination != chego.Unterminated {
-		return false
-	}
-
-	switch id {
-	case g.white.Id:
-		g.Terminate(chego.Resignation, chego.BlackWon)
-	case g.black.Id:
-		g.Terminate(chego.Resignation, chego.WhiteWon)
-	}
-	g.store()
-	return true
+// ratings estimates the players' ratings after the game.  Implements
+// [db.RateFunc].
+func (g *RatedGame) ratings(white, black db.Player) (db.RatingUpdate, db.RatingUpdate) {
+	whiteScore, blackScore := scores(g.Result)
+	return DefaultRatingParams.estimate(white, black, whiteScore),
+		DefaultRatingParams.estimate(black, white, blackScore)
 }
 
-// OfferDraw handles draw offers. Offer will be discarded if one of the
-// following is true:
-//   - There were not enough moves played to terminate the game;
-//   - The game is already terminated;
-//   - Sender is not a white nor a black player;
-//   - One of the players has already sent a pending draw offer;
-//   - The player has sent a draw offer not so long ago.
-//
-// Returns empty string if offer was discarded and opponent id otherwise.
-func (g *RatedGame) OfferDraw(id string) string {
-	if len(g.Played) < minMoves ||
-		g.Termination != chego.Unterminated ||
-		(id != g.white.Id && id != g.black.Id) ||
-		(id == g.white.Id && g.didWhiteOfferDraw) ||
-		(id == g.black.Id && g.bidBlackOfferDraw) ||
-		len(g.drawIssuer) != 0 {
-		return ""
-	}
-	g.drawIssuer = id
-
-	switch id {
-	case g.white.Id:
-		g.didWhiteOfferDraw = true
-		return g.black.Id
-	default:
-		g.bidBlackOfferDraw = true
-		return g.white.Id
+// scores returns the scores of the white and the black player.
+func scores(r chego.Result) (float64, float64) {
+	switch r {
+	case chego.WhiteWon:
+		return 1, 0
+	case chego.BlackWon:
+		return 0, 1
+	case chego.Draw:
+		return 0.5, 0.5
 	}
+	return 0, 0
 }
 
-func (g *RatedGame) AcceptDraw(id string) bool {
-	if len(g.drawIssuer) == 0 ||
-		id == g.drawIssuer ||
-		(id != g.white.Id && id != g.black.Id) {
-		return false
+// GamePayload returns the game state along with the rating changes preview.
+func (g *RatedGame) GamePayload() GamePayload {
+	p := g.liveGame.GamePayload()
+	p.Preview = &RatingPreview{
+		White: preview(g.white, g.black),
+		Black: preview(g.black, g.white),
 	}
-	g.drawIssuer = ""
-	g.Terminate(chego.Agreement, chego.Draw)
-	g.store()
-	return true
+	return p
 }
 
-func (g *RatedGame) DeclineDraw(id string) bool {
-	if len(g.drawIssuer) == 0 ||
-		id == g.drawIssuer ||
-		(id != g.white.Id && id != g.black.Id) {
-		return false
-	}
-	g.drawIssuer = ""
-	return true
+// RatingPreview describes the projected rating changes of the players for each
+// result of the game.
+type RatingPreview struct {
+	White SidePreview `json:"w"`
+	Black SidePreview `json:"b"`
 }
 
-func (g *RatedGame) Abandon() {
-	if g.Termination == chego.Unterminated {
-		g.Termination = chego.Abandoned
-		if err := g.gameRepo.MarkRatedAsAbandoned(g.id); err != nil {
-			log.Print(err)
-		}
-	}
+type SidePreview struct {
+	Win  float64 `json:"w"`
+	Draw float64 `json:"d"`
+	Loss float64 `json:"l"`
+	// Whether the player's rating is provisional, i.e. the deviation is too high
+	// for the rating to be reliable.
+	IsProvisional bool `json:"p,omitempty"`
 }
 
-func (g *RatedGame) store() {
-	if err := g.gameRepo.UpdateRated(db.RatedGameUpdate{
-		Id: g.id, Result: g.Result, Termination: g.Termination,
-		EncodedMoves:    chego.HuffmanEncoding(g.playedIndices),
-		CompressedDiffs: chego.CompressTimeDiffs(g.timeDiffs),
-		MovesLength:     len(g.Played),
-	}); err != nil {
-		log.Print(err)
-		return
-	}
-
-	if err := g.updateRatings(); err != nil {
-		log.Print(err)
+func preview(p, opponent db.Player) SidePreview {
+	rp := DefaultRatingParams
+	return SidePreview{
+		Win:           rp.estimate(p, opponent, 1).Rating - p.Rating,
+		Draw:          rp.estimate(p, opponent, 0.5).Rating - p.Rating,
+		Loss:          rp.estimate(p, opponent, 0).Rating - p.Rating,
+		IsProvisional: p.Deviation > provisionalDeviation,
 	}
 }
 
-func (g *RatedGame) updateRatings() error {
+// estimate returns the player's rating after the game against the opponent with
+// the specified score.
+func (rp RatingParams) estimate(p, opponent db.Player, score float64) db.RatingUpdate {
 	c := glicko.Converter{
 		Rating:    glicko.DefaultRating,
 		Deviation: glicko.DefaultDeviation,
 		Factor:    glicko.DefaultFactor,
 	}
 
-	// Initial players' strength.
-	wStr := glicko.Strength{
-		Mu:    c.Rating2Mu(g.white.Rating),
-		Phi:   c.Deviation2Phi(g.white.Deviation),
-		Sigma: g.white.Volatility,
+	// Initial player's strength.
+	str := glicko.Strength{
+		Mu:    c.Rating2Mu(p.Rating),
+		Phi:   c.Deviation2Phi(p.Deviation),
+		Sigma: p.Volatility,
 	}
-	bStr := glicko.Strength{
-		Mu:    c.Rating2Mu(g.black.Rating),
-		Phi:   c.Deviation2Phi(g.black.Deviation),
-		Sigma: g.black.Volatility,
-	}
-
-	var whiteScore, blackScore float64
-	switch g.Result {
-	case chego.WhiteWon:
-		whiteScore = 1
-		blackScore = 0
-	case chego.BlackWon:
-		whiteScore = 0
-		blackScore = 1
-	case chego.Draw:
-		whiteScore = 0.5
-		blackScore = 0.5
-	}
-
-	wOut := glicko.Outcome{
-		Mu:    bStr.Mu,
-		Phi:   bStr.Phi,
-		Score: whiteScore,
-	}
-	bOut := glicko.Outcome{
-		Mu:    wStr.Mu,
-		Phi:   wStr.Phi,
-		Score: blackScore,
+	out := glicko.Outcome{
+		Mu:    c.Rating2Mu(opponent.Rating),
+		Phi:   c.Deviation2Phi(opponent.Deviation),
+		Score: score,
 	}
 
 	e := glicko.Estimator{
-		MinMu:    c.Rating2Mu(minRating),
-		MaxMu:    c.Rating2Mu(maxRating),
-		MinPhi:   c.Deviation2Phi(minDeviation),
+		MinMu:    c.Rating2Mu(rp.MinRating),
+		MaxMu:    c.Rating2Mu(rp.MaxRating),
+		MinPhi:   c.Deviation2Phi(rp.MinDeviation),
 		MaxPhi:   c.Deviation2Phi(glicko.DefaultDeviation),
-		MinSigma: minSigma, MaxSigma: maxSigma,
-		Tau: glicko.DefaultTau, Epsilon: glicko.DefaultEpsilon,
-	}
-
-	e.Estimate(&wStr, wOut, 1)
-	e.Estimate(&bStr, bOut, 1)
-
-	return g.playerRepo.UpdateRatings(
-		db.RatingUpdate{
-			Id:         g.white.Id,
-			Rating:     c.Mu2Rating(wStr.Mu),
-			Deviation:  c.Phi2Deviation(wStr.Phi),
-			Volatility: wStr.Sigma,
-		},
-		db.RatingUpdate{
-			Id:         g.black.Id,
-			Rating:     c.Mu2Rating(bStr.Mu),
-			Deviation:  c.Phi2Deviation(bStr.Phi),
-			Volatility: bStr.Sigma,
-		},
-	)
-}
-
-func (g *RatedGame) GamePayload() GamePayload {
-	return GamePayload{
-		Legal:     g.Legal.Moves[:g.Legal.LastMoveIndex],
-		Played:    g.Played,
-		WhiteTime: g.clock.whiteTime,
-		BlackTime: g.clock.blackTime,
+		MinSigma: rp.MinSigma, MaxSigma: rp.MaxSigma,
+		Tau: rp.Tau, Epsilon: glicko.DefaultEpsilon,
 	}
-}
+	e.Estimate(&str, out, 1)
 
-func (g *RatedGame) EndPayload() EndPayload {
-	return EndPayload{
-		Termination: g.Termination,
-		Result:      g.Result,
+	return db.RatingUpdate{
+		Id:         p.Id,
+		Rating:     c.Mu2Rating(str.Mu),
+		Deviation:  c.Phi2Deviation(str.Phi),
+		Volatility: str.Sigma,
 	}
 }
@@ -0,0 +1,136 @@
+package game
+
+import (
+	"testing"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/chego"
+)
+
+// finalizeRepo rates the game against the stored players the same way the SQL
+// repository does and records the arguments of FinalizeRated.  Other methods
+// must not be called.
+type finalizeRepo struct {
+	db.GameRepo
+	// Players as they are stored in the repository.
+	players  map[string]db.Player
+	category db.Category
+	update   db.RatedGameUpdate
+	white    db.RatingUpdate
+	black    db.RatingUpdate
+}
+
+func (r *finalizeRepo) FinalizeRated(gu db.RatedGameUpdate, c db.Category,
+	whiteId, blackId string, rate db.RateFunc,
+) error {
+	r.category = c
+	r.white, r.black = gu.Rate(r.players[whiteId], r.players[blackId], rate)
+	r.update = gu
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	// Ratings the players had at the start of the game.
+	start := db.Player{Rating: 1500, Deviation: 350, Volatility: 0.06}
+	white, black := start, start
+	white.Id, black.Id = "w", "b"
+
+	cases := []struct {
+		result      chego.Result
+		white       db.Player
+		black       db.Player
+		isWhiteGain bool
+		isBlackGain bool
+	}{
+		{
+			chego.WhiteWon,
+			db.Player{Id: "w", Rating: 1800, Deviation: 60, Volatility: 0.06},
+			db.Player{Id: "b", Rating: 1400, Deviation: 200, Volatility: 0.06},
+			true, false,
+		},
+		{
+			chego.BlackWon,
+			db.Player{Id: "w", Rating: 1450, Deviation: 80, Volatility: 0.05},
+			db.Player{Id: "b", Rating: 2000, Deviation: 120, Volatility: 0.07},
+			false, true,
+		},
+		{
+			chego.Draw,
+			db.Player{Id: "w", Rating: 1300, Deviation: 90, Volatility: 0.06},
+			db.Player{Id: "b", Rating: 1700, Deviation: 90, Volatility: 0.06},
+			true, false,
+		},
+	}
+
+	for i, tc := range cases {
+		r := &finalizeRepo{players: map[string]db.Player{"w": tc.white, "b": tc.black}}
+		g := newRatedGame(newLiveGame("id", white, black, db.TimeControl{Control: 180}, ""), r)
+		g.Result, g.Termination = tc.result, chego.Resignation
+		g.store()
+
+		if r.category != db.Blitz {
+			t.Fatalf("case %d: expected: %s, got: %s", i, db.Blitz, r.category)
+		}
+		if r.update.Id != "id" || r.update.Result != tc.result ||
+			r.update.Termination != chego.Resignation {
+			t.Fatalf("case %d: unexpected update: %+v", i, r.update)
+		}
+
+		// Ratings must be estimated from the stored players instead of the
+		// ones the players had at the start of the game.
+		whiteScore, blackScore := scores(tc.result)
+		wu := DefaultRatingParams.estimate(tc.white, tc.black, whiteScore)
+		bu := DefaultRatingParams.estimate(tc.black, tc.white, blackScore)
+		if r.white != wu || r.black != bu {
+			t.Fatalf("case %d: expected: %+v %+v, got: %+v %+v", i, wu, bu, r.white, r.black)
+		}
+
+		expected := [2]db.RatingChange{
+			{Rating: tc.white.Rating, Delta: wu.Rating - tc.white.Rating},
+			{Rating: tc.black.Rating, Delta: bu.Rating - tc.black.Rating},
+		}
+		got := [2]db.RatingChange{r.update.White, r.update.Black}
+		if got != expected {
+			t.Fatalf("case %d: expected: %+v, got: %+v", i, expected, got)
+		}
+		if (got[0].Delta > 0) != tc.isWhiteGain || (got[1].Delta > 0) != tc.isBlackGain {
+			t.Fatalf("case %d: unexpected deltas: %+v", i, got)
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	cases := []struct {
+		deviation float64
+		expected  bool
+	}{
+		{350, true},
+		{provisionalDeviation + 1, true},
+		{provisionalDeviation, false},
+		{minDeviation, false},
+	}
+
+	for i, tc := range cases {
+		w := db.Player{Id: "w", Rating: 1500, Deviation: tc.deviation, Volatility: 0.06}
+		b := db.Player{Id: "b", Rating: 1500, Deviation: 60, Volatility: 0.06}
+		g := newRatedGame(newLiveGame("id", w, b, db.TimeControl{Control: 60}, ""), &finalizeRepo{})
+
+		p := g.GamePayload().Preview
+		if p == nil {
+			t.Fatalf("case %d: preview is missing", i)
+		}
+		if p.White.IsProvisional != tc.expected || p.Black.IsProvisional {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, p.White.IsProvisional)
+		}
+		for _, sp := range []SidePreview{p.White, p.Black} {
+			if sp.Win <= 0 || sp.Loss >= 0 || sp.Win <= sp.Draw || sp.Draw <= sp.Loss {
+				t.Fatalf("case %d: unordered deltas: %+v", i, sp)
+			}
+		}
+		// The provisional rating changes faster.
+		if tc.expected && (p.White.Win <= p.Black.Win || p.White.Loss >= p.Black.Loss) {
+			t.Fatalf("case %d: expected larger deltas: %+v, got: %+v", i, p.Black, p.White)
+		}
+	}
+}
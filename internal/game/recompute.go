@@ -0,0 +1,89 @@
+package game
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/glicko"
+)
+
+// ratingKey identifies the player's rating in the category.
+type ratingKey struct {
+	id string
+	c  db.Category
+}
+
+// Recompute replays the results of the rated games in the specified order
+// starting from the initial ratings.  The deviations are decayed for rating
+// periods without games, including the ones which have passed until now.
+// Returns the rating changes of each game and the final ratings sorted by the
+// player id and the category.
+func Recompute(results []db.RatedResult, rp RatingParams, now time.Time,
+) ([]db.RecomputedGame, []db.CategoryRating) {
+	ratings := make(map[ratingKey]*db.CategoryRating)
+	// rating returns the player's rating at the moment the game was completed.
+	rating := func(id string, c db.Category, at time.Time) *db.CategoryRating {
+		cr, exists := ratings[ratingKey{id, c}]
+		if !exists {
+			cr = &db.CategoryRating{
+				Id:         id,
+				Category:   c,
+				Rating:     glicko.DefaultRating,
+				Deviation:  glicko.DefaultDeviation,
+				Volatility: glicko.DefaultVolatility,
+			}
+			ratings[ratingKey{id, c}] = cr
+			return cr
+		}
+		periods := int(at.Sub(cr.LastGameAt) / ratingPeriod)
+		cr.Deviation = decay(cr.Deviation, cr.Volatility, periods)
+		return cr
+	}
+
+	games := make([]db.RecomputedGame, 0, len(results))
+	for _, r := range results {
+		c := r.Control.Category()
+		white := rating(r.WhiteId, c, r.CompletedAt)
+		black := rating(r.BlackId, c, r.CompletedAt)
+
+		wp, bp := player(white), player(black)
+		whiteScore, blackScore := scores(r.Result)
+		wu := rp.estimate(wp, bp, whiteScore)
+		bu := rp.estimate(bp, wp, blackScore)
+
+		games = append(games, db.RecomputedGame{
+			RatedResult: r,
+			White:       db.RatingChange{Rating: wp.Rating, Delta: wu.Rating - wp.Rating},
+			Black:       db.RatingChange{Rating: bp.Rating, Delta: bu.Rating - bp.Rating},
+		})
+
+		white.Rating, white.Deviation, white.Volatility =
+			wu.Rating, wu.Deviation, wu.Volatility
+		black.Rating, black.Deviation, black.Volatility =
+			bu.Rating, bu.Deviation, bu.Volatility
+		white.LastGameAt, black.LastGameAt = r.CompletedAt, r.CompletedAt
+	}
+
+	final := make([]db.CategoryRating, 0, len(ratings))
+	for _, cr := range ratings {
+		cr.DecayedPeriods = int(now.Sub(cr.LastGameAt) / ratingPeriod)
+		cr.Deviation = decay(cr.Deviation, cr.Volatility, cr.DecayedPeriods)
+		final = append(final, *cr)
+	}
+	slices.SortFunc(final, func(a, b db.CategoryRating) int {
+		return cmp.Or(cmp.Compare(a.Id, b.Id), cmp.Compare(a.Category, b.Category))
+	})
+	return games, final
+}
+
+func player(cr *db.CategoryRating) db.Player {
+	return db.Player{
+		Id:         cr.Id,
+		Rating:     cr.Rating,
+		Deviation:  cr.Deviation,
+		Volatility: cr.Volatility,
+	}
+}
@@ -0,0 +1,59 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+
+	"github.com/treepeck/chego"
+)
+
+func TestRecompute(t *testing.T) {
+	start := time.Now().Add(-10 * ratingPeriod)
+	blitz := db.TimeControl{Control: 300}
+	bullet := db.TimeControl{Control: 60}
+	results := []db.RatedResult{
+		{CompletedAt: start, Id: "1", WhiteId: "a", BlackId: "b", Control: blitz,
+			Result: chego.WhiteWon},
+		{CompletedAt: start.Add(time.Hour), Id: "2", WhiteId: "a", BlackId: "b",
+			Control: blitz, Result: chego.Draw},
+		{CompletedAt: start.Add(3 * ratingPeriod), Id: "3", WhiteId: "b",
+			BlackId: "a", Control: bullet, Result: chego.BlackWon},
+	}
+
+	games, ratings := Recompute(results, DefaultRatingParams, time.Now())
+	if len(games) != len(results) {
+		t.Fatalf("expected: %d games, got: %d", len(results), len(games))
+	}
+	// Each game starts from the ratings after the previous one in the category.
+	for _, side := range [][2]db.RatingChange{
+		{games[0].White, games[1].White}, {games[0].Black, games[1].Black},
+	} {
+		if side[0].Rating+side[0].Delta != side[1].Rating {
+			t.Fatalf("expected: %f, got: %f", side[0].Rating+side[0].Delta, side[1].Rating)
+		}
+	}
+
+	cases := []struct {
+		id       string
+		category db.Category
+		periods  int
+	}{
+		{"a", db.Bullet, 7},
+		{"a", db.Blitz, 9},
+		{"b", db.Bullet, 7},
+		{"b", db.Blitz, 9},
+	}
+	if len(ratings) != len(cases) {
+		t.Fatalf("expected: %d ratings, got: %d", len(cases), len(ratings))
+	}
+	for i, tc := range cases {
+		got := ratings[i]
+		if got.Id != tc.id || got.Category != tc.category ||
+			got.DecayedPeriods != tc.periods {
+			t.Fatalf("case %d: expected: %s %s %d, got: %s %s %d", i, tc.id,
+				tc.category, tc.periods, got.Id, got.Category, got.DecayedPeriods)
+		}
+	}
+}
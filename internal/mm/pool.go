@@ -20,8 +20,12 @@ func NewPool() Pool { return Pool{tree: newRedBlackTree()} }
 
 // It's the caller's responsibility to ensure that a single client doesn't join
 // more than once.
-func (p Pool) Join(id string, rating float64) {
+//
+// Players with uncertain ratings, i.e. with the high deviation, are allowed to
+// be paired with players within the 95% confidence interval of their rating.
+func (p Pool) Join(id string, rating, deviation float64) {
 	n := p.tree.spawn(rating, id)
+	n.key.maxGap = max(defaultMaxGap, 2*deviation)
 	p.tree.insertNode(n)
 }
 
@@ -0,0 +1,313 @@
+// Package position implements custom starting positions specified by FEN.
+// Games without the custom position start from the standard one, which is
+// denoted by the empty FEN.
+package position
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/treepeck/chego"
+)
+
+var (
+	errFields    = errors.New("position: FEN must contain 6 fields")
+	errPlacement = errors.New("position: malformed piece placement")
+	errKings     = errors.New("position: each side must have a single king")
+	errPawns     = errors.New("position: pawns cannot stand on the first and the last rank")
+	errColor     = errors.New("position: malformed active color")
+	errCastling  = errors.New("position: malformed castling rights")
+	errEnPassant = errors.New("position: malformed en passant target")
+	errClocks    = errors.New("position: malformed move counters")
+	errCheck     = errors.New("position: the side not to move is in check")
+	errNoMoves   = errors.New("position: there are no legal moves in the position")
+)
+
+// Validate reports whether the FEN specifies the position in which the game
+// can be started.
+func Validate(fen string) error {
+	fields := strings.Fields(fen)
+	if len(fields) != 6 {
+		return errFields
+	}
+
+	b, err := parseBoard(fields[0])
+	if err != nil {
+		return err
+	}
+	if fields[1] != "w" && fields[1] != "b" {
+		return errColor
+	}
+	isWhite := fields[1] == "w"
+	if !isCastling(fields[2]) || !b.canCastle(fields[2]) {
+		return errCastling
+	}
+	if ep := fields[3]; ep != "-" && !b.isEnPassant(ep, isWhite) {
+		return errEnPassant
+	}
+	if halfmoves, err := strconv.Atoi(fields[4]); err != nil || halfmoves < 0 {
+		return errClocks
+	}
+	if moves, err := strconv.Atoi(fields[5]); err != nil || moves < 1 {
+		return errClocks
+	}
+	// Otherwise the king could be captured by the first move.
+	if b.isAttacked(b.king(!isWhite), isWhite) {
+		return errCheck
+	}
+
+	// The game cannot be started in the terminated position.
+	if g := NewGame(fen); g.Legal.LastMoveIndex == 0 {
+		return errNoMoves
+	}
+	return nil
+}
+
+// board is the piece placement indexed by squares from a1 to h8.  Empty
+// squares are zero.
+type board [64]byte
+
+// parseBoard parses and validates the piece placement field, e.g.
+// "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR".
+func parseBoard(placement string) (board, error) {
+	var b board
+	ranks := strings.Split(placement, "/")
+	if len(ranks) != 8 {
+		return b, errPlacement
+	}
+
+	kings := map[byte]int{}
+	for i, rank := range ranks {
+		// The first rank in FEN is the eighth one.
+		r := 7 - i
+		file := 0
+		for _, c := range []byte(rank) {
+			switch {
+			case c >= '1' && c <= '8':
+				file += int(c - '0')
+			case strings.IndexByte("pnbrqkPNBRQK", c) != -1:
+				if file > 7 {
+					return b, errPlacement
+				}
+				if c == 'k' || c == 'K' {
+					kings[c]++
+				}
+				if (c == 'p' || c == 'P') && (r == 0 || r == 7) {
+					return b, errPawns
+				}
+				b[r*8+file] = c
+				file++
+			default:
+				return b, errPlacement
+			}
+		}
+		if file != 8 {
+			return b, errPlacement
+		}
+	}
+
+	if kings['k'] != 1 || kings['K'] != 1 {
+		return b, errKings
+	}
+	return b, nil
+}
+
+// king returns the square of the king of the specified side.
+func (b board) king(isWhite bool) int {
+	k := byte('k')
+	if isWhite {
+		k = 'K'
+	}
+	for sq, p := range b {
+		if p == k {
+			return sq
+		}
+	}
+	return -1
+}
+
+// canCastle reports whether the kings and the rooks stand on their initial
+// squares for each of the castling rights.
+func (b board) canCastle(castling string) bool {
+	for _, c := range castling {
+		var king, rook int
+		var k, r byte
+		switch c {
+		case 'K':
+			king, rook, k, r = 4, 7, 'K', 'R'
+		case 'Q':
+			king, rook, k, r = 4, 0, 'K', 'R'
+		case 'k':
+			king, rook, k, r = 60, 63, 'k', 'r'
+		case 'q':
+			king, rook, k, r = 60, 56, 'k', 'r'
+		default:
+			continue
+		}
+		if b[king] != k || b[rook] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// isEnPassant reports whether the target square is the one skipped by the
+// pawn of the opponent which has just made the double push.
+func (b board) isEnPassant(target string, isWhite bool) bool {
+	if len(target) != 2 || target[0] < 'a' || target[0] > 'h' {
+		return false
+	}
+	file := int(target[0] - 'a')
+	// Squares from which and to which the pawn has been pushed.
+	from, to, rank, pawn := 6, 4, byte('6'), byte('p')
+	if !isWhite {
+		from, to, rank, pawn = 1, 3, '3', 'P'
+	}
+	return target[1] == rank && b[to*8+file] == pawn &&
+		b[from*8+file] == 0 && b[(from+to)/2*8+file] == 0
+}
+
+// isAttacked reports whether the square is attacked by the pieces of the
+// specified side.
+func (b board) isAttacked(sq int, byWhite bool) bool {
+	// piece returns the attacker's piece or zero if the square is off the
+	// board.
+	piece := func(file, rank int) byte {
+		if file < 0 || file > 7 || rank < 0 || rank > 7 {
+			return 0
+		}
+		return b[rank*8+file]
+	}
+	// own converts the white piece to the piece of the attacking side.
+	own := func(p byte) byte {
+		if byWhite {
+			return p
+		}
+		return p | 0x20
+	}
+
+	file, rank := sq%8, sq/8
+	pawnRank := rank - 1
+	if !byWhite {
+		pawnRank = rank + 1
+	}
+	if piece(file-1, pawnRank) == own('P') || piece(file+1, pawnRank) == own('P') {
+		return true
+	}
+
+	for _, d := range [...][2]int{
+		{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2},
+	} {
+		if piece(file+d[0], rank+d[1]) == own('N') {
+			return true
+		}
+	}
+
+	for _, d := range [...][2]int{
+		{0, 1}, {1, 0}, {0, -1}, {-1, 0}, {1, 1}, {1, -1}, {-1, -1}, {-1, 1},
+	} {
+		// Rooks attack along ranks and files, bishops along diagonals.
+		slider := own('R')
+		if d[0] != 0 && d[1] != 0 {
+			slider = own('B')
+		}
+		for i := 1; ; i++ {
+			f, r := file+i*d[0], rank+i*d[1]
+			if f < 0 || f > 7 || r < 0 || r > 7 {
+				break
+			}
+			p := piece(f, r)
+			if (i == 1 && p == own('K')) || p == slider || p == own('Q') {
+				return true
+			}
+			if p != 0 {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// isCastling reports whether the castling field is either "-" or contains each
+// of "KQkq" at most once in the same order.
+func isCastling(castling string) bool {
+	if castling == "-" {
+		return true
+	}
+	rest := "KQkq"
+	for _, c := range castling {
+		i := strings.IndexRune(rest, c)
+		if i == -1 {
+			return false
+		}
+		rest = rest[i+1:]
+	}
+	return len(castling) > 0
+}
+
+// NewGame returns the game which starts from the specified position.  The FEN
+// must be validated beforehand.
+func NewGame(fen string) chego.Game {
+	g := chego.NewGame()
+	if len(fen) == 0 {
+		return g
+	}
+	g.Position = chego.ParseFEN(fen)
+	g.Legal = chego.MoveList{}
+	chego.GenLegalMoves(g.Position, &g.Legal)
+	return g
+}
+
+// Replay returns the game which starts from the specified position with the
+// moves of the specified indices played.
+func Replay(fen string, indices []byte) chego.Game {
+	g := NewGame(fen)
+	for _, i := range indices {
+		g.Push(g.Legal.Moves[i])
+	}
+	return g
+}
+
+// rawIndices marks the moves encoded from the custom position.
+const rawIndices byte = 0xFF
+
+// Encode encodes the indices of the moves played from the specified position.
+// Moves played from the standard position are Huffman-encoded, since the
+// Huffman decoder replays them from the standard position only.  Moves played
+// from the custom position are stored as the [rawIndices] marker followed by
+// one byte per move index.
+func Encode(fen string, indices []byte) []byte {
+	if len(fen) == 0 {
+		return chego.HuffmanEncoding(indices)
+	}
+	return append([]byte{rawIndices}, indices...)
+}
+
+// Decode decodes the moves encoded with [Encode].  Returns nil if the moves
+// from the custom position lack the format marker or contain an illegal index.
+func Decode(fen string, encoded []byte, length int) []chego.PlayedMove {
+	if len(fen) == 0 {
+		return chego.HuffmanDecoding(encoded, length)
+	}
+	if len(encoded) == 0 || encoded[0] != rawIndices {
+		return nil
+	}
+
+	g := NewGame(fen)
+	for _, i := range encoded[1:min(length+1, len(encoded))] {
+		if i >= g.Legal.LastMoveIndex {
+			return nil
+		}
+		g.Push(g.Legal.Moves[i])
+	}
+	return g.Played
+}
+
+// ActiveColor returns the side to move in the position.
+func ActiveColor(fen string) chego.Color {
+	if f := strings.Fields(fen); len(f) > 1 && f[1] == "b" {
+		return chego.ColorBlack
+	}
+	return chego.ColorWhite
+}
@@ -0,0 +1,94 @@
+package position
+
+import (
+	"testing"
+
+	"github.com/treepeck/chego"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		fen      string
+		expected error
+	}{
+		{"", errFields},
+		{"8/8/4k3/8/8/4K3/8/8 w - -", errFields},
+		{"8/8/4k3/8/8/4K3/8 w - - 0 1", errPlacement},
+		{"8/8/4k3/8/8/4K3/8/7 w - - 0 1", errPlacement},
+		{"8/8/4k3/8/8/4K3/8/x7 w - - 0 1", errPlacement},
+		{"8/8/8/8/8/4K3/8/8 w - - 0 1", errKings},
+		{"8/8/4k3/8/8/4KK2/8/8 w - - 0 1", errKings},
+		{"P7/8/4k3/8/8/4K3/8/8 w - - 0 1", errPawns},
+		{"8/8/4k3/8/8/4K3/8/8 x - - 0 1", errColor},
+		{"8/8/4k3/8/8/4K3/8/8 w KK - 0 1", errCastling},
+		{"8/8/4k3/8/8/4K3/8/8 w qK - 0 1", errCastling},
+		{"8/8/4k3/8/8/4K3/8/8 w - e3 0 1", errEnPassant},
+		{"8/8/4k3/8/8/4K3/8/8 w - - -1 1", errClocks},
+		{"8/8/4k3/8/8/4K3/8/8 w - - 0 0", errClocks},
+		// Castling rights without the king or the rook on its initial square.
+		{"r3k2r/8/8/8/8/8/8/R4K1R w K - 0 1", errCastling},
+		{"r3k2r/8/8/8/8/8/8/1R2K2R w Q - 0 1", errCastling},
+		{"r3k1r1/8/8/8/8/8/8/R3K2R w k - 0 1", errCastling},
+		{"r2k3r/8/8/8/8/8/8/R3K2R w q - 0 1", errCastling},
+		// En passant target without the pawn which has made the double push.
+		{"4k3/8/8/8/8/8/8/4K3 w - e6 0 1", errEnPassant},
+		{"4k3/4p3/8/4p3/8/8/8/4K3 w - e6 0 1", errEnPassant},
+		{"4k3/8/8/8/4P3/8/8/4K3 w - e3 0 1", errEnPassant},
+		{"4k3/8/8/8/4P3/8/4P3/4K3 b - e3 0 1", errEnPassant},
+		// The side not to move is in check.
+		{"4k3/8/8/8/8/8/8/4R1K1 w - - 0 1", errCheck},
+		{"4k3/8/8/1B6/8/8/8/6K1 w - - 0 1", errCheck},
+		{"4k3/8/3N4/8/8/8/8/6K1 w - - 0 1", errCheck},
+		{"4k3/3P4/8/8/8/8/8/6K1 w - - 0 1", errCheck},
+		{"8/8/8/8/8/8/3p4/4K1k1 b - - 0 1", errCheck},
+		{"8/8/8/8/8/8/8/3kK3 b - - 0 1", errCheck},
+	}
+
+	for i, tc := range cases {
+		if got := Validate(tc.fen); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestActiveColor(t *testing.T) {
+	cases := []struct {
+		fen      string
+		expected chego.Color
+	}{
+		{"", chego.ColorWhite},
+		{"8/8/4k3/8/8/4K3/8/8 w - - 0 1", chego.ColorWhite},
+		{"8/8/4k3/8/8/4K3/8/8 b - - 0 1", chego.ColorBlack},
+	}
+
+	for i, tc := range cases {
+		if got := ActiveColor(tc.fen); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	const fen = "8/8/4k3/8/8/4K3/8/8 w - - 0 1"
+
+	cases := []struct {
+		encoded  []byte
+		length   int
+		expected int
+	}{
+		{Encode(fen, []byte{0, 1}), 2, 2},
+		{Encode(fen, nil), 0, 0},
+		// Only the specified number of moves is decoded.
+		{Encode(fen, []byte{0, 1}), 1, 1},
+		// The format marker is missing.
+		{[]byte{0, 1}, 2, 0},
+		// The index is out of the legal moves.
+		{Encode(fen, []byte{0, 255}), 2, 0},
+	}
+
+	for i, tc := range cases {
+		if got := Decode(fen, tc.encoded, tc.length); len(got) != tc.expected {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.expected, len(got))
+		}
+	}
+}
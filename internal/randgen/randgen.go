@@ -22,3 +22,12 @@ func GenId(n int) string {
 
 	return base64.RawURLEncoding.EncodeToString(buff)
 }
+
+// IsId reports whether s might have been generated by [GenId] with the same n.
+func IsId(s string, n int) bool {
+	if len(s) != base64.RawURLEncoding.EncodedLen(n) {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil
+}
@@ -2,6 +2,26 @@ package randgen
 
 import "testing"
 
+func TestIsId(t *testing.T) {
+	cases := []struct {
+		id       string
+		expected bool
+	}{
+		{GenId(IdLen), true},
+		{GenId(SecureIdLen), false},
+		{"0", false},
+		{"c1", false},
+		{"abcdefghijk!", false},
+		{"abcdefghij-_", true},
+	}
+
+	for i, tc := range cases {
+		if got := IsId(tc.id, IdLen); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+	}
+}
+
 func BenchmarkGenId(b *testing.B) {
 	for b.Loop() {
 		GenId(SecureIdLen)
@@ -3,19 +3,46 @@
 package web
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"justchess/internal/auth"
 	"justchess/internal/db"
+	"justchess/internal/game"
+	"justchess/internal/randgen"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/treepeck/chego"
 )
 
 // Declaration of error messages.
 const (
-	msgNotFound    = "The requested page wasn't found"
-	msgRenderError = "The requested page wasn't rendered successfully"
-	msgDBError     = "Database cannot be accessed. Please, try again later"
+	msgNotFound       = "The requested page wasn't found"
+	msgRenderError    = "The requested page wasn't rendered successfully"
+	msgDBError        = "Database cannot be accessed. Please, try again later"
+	msgBadRequest     = "Request is malformed"
+	msgTooLarge       = "Too many games to import at once"
+	msgSignupToImport = "Please, sign up to import games"
+)
+
+const (
+	// Maximal size of the imported PGN file in bytes.
+	maxImportSize = 1 << 20
+	// Maximal number of games imported at once.
+	maxImportedGames = 100
 )
 
+// leaderboard is a data object used to fill up the leaderboard.tmpl file.
+type leaderboard struct {
+	Categories []db.Category
+	Leaders    []db.Profile
+	Category   db.Category
+}
+
 // Service serves [page]s and assets from the file system.
 type Service struct {
 	gameRepo   db.GameRepo
@@ -66,14 +93,22 @@ func InitService(gr db.GameRepo, pr db.PlayerRepo, folder string) (Service, erro
 	}, nil
 }
 
-func (s Service) RegisterRoutes(mux *http.ServeMux) {
+func (s Service) RegisterRoutes(authService auth.Service, mux *http.ServeMux) {
 	mux.HandleFunc("GET /", s.static)
 
 	// Serve pages with dynamic content.
 	mux.HandleFunc("GET /leaderboard", s.leaderboard)
 	mux.HandleFunc("GET /player/{id}", s.profile)
+	mux.HandleFunc("GET /player/{id}/ratings", s.ratingHistory)
+	mux.HandleFunc("GET /player/{id}/games.pgn", s.exportGames)
+	mux.HandleFunc("GET /player/{id}/imported", s.importedGames)
 	mux.HandleFunc("GET /engine/{id}", s.engineGame)
 	mux.HandleFunc("GET /rated/{id}", s.ratedGame)
+	mux.HandleFunc("GET /casual/{id}", s.casualGame)
+	mux.HandleFunc("GET /correspondence/{id}", s.correspondenceGame)
+	mux.HandleFunc("GET /invite/{id}", s.invitation)
+	mux.HandleFunc("GET /imported/{id}", s.importedGame)
+	mux.HandleFunc("POST /import", authService.MustAuthorize(s.importGames))
 
 	// Serve assets.
 	mux.Handle("GET /assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("_web/assets"))))
@@ -85,12 +120,22 @@ func (s Service) static(rw http.ResponseWriter, r *http.Request) {
 }
 
 func (s Service) leaderboard(rw http.ResponseWriter, r *http.Request) {
-	leaderboard, err := s.playerRepo.SelectLeaderboard()
+	// Blitz leaderboard is shown by default.
+	c, ok := db.ParseCategory(r.URL.Query().Get("category"))
+	if !ok {
+		c = db.Blitz
+	}
+
+	leaders, err := s.playerRepo.SelectLeaderboard(c)
 	if err != nil {
 		s.renderPage(rw, "/error", msgDBError)
 		return
 	}
-	s.renderPage(rw, "/leaderboard", leaderboard)
+	s.renderPage(rw, "/leaderboard", leaderboard{
+		Categories: db.Categories[:],
+		Leaders:    leaders,
+		Category:   c,
+	})
 }
 
 func (s Service) profile(rw http.ResponseWriter, r *http.Request) {
@@ -99,25 +144,295 @@ func (s Service) profile(rw http.ResponseWriter, r *http.Request) {
 		s.renderPage(rw, "/error", msgNotFound)
 		return
 	}
+	// Used to challenge the player.
+	profile.Id = r.PathValue("id")
 	s.renderPage(rw, "/player", profile)
 }
 
+// ratingHistory responds with the player's rating history encoded as JSON.
+// Used to draw the rating chart on the player page.
+func (s Service) ratingHistory(rw http.ResponseWriter, r *http.Request) {
+	history, err := s.playerRepo.SelectRatingHistory(r.PathValue("id"))
+	if err != nil {
+		http.Error(rw, msgDBError, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(history); err != nil {
+		log.Print(err)
+	}
+}
+
+// exportGames streams all terminated rated, casual and engine games of the
+// player in PGN.  Games are selected page by page, so the response is written
+// before all games are selected.  Errors occurred after the first page cannot
+// be reported, thus the response is simply cut.
+func (s Service) exportGames(rw http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.playerRepo.SelectProfile(id); err != nil {
+		http.Error(rw, msgNotFound, http.StatusNotFound)
+		return
+	}
+	setPGNHeaders(rw, "games")
+
+	writeRated := func(isCasual bool) func(db.RatedGameBrief) error {
+		selectGame := s.gameRepo.SelectRated
+		if isCasual {
+			selectGame = s.gameRepo.SelectCasual
+		}
+		return func(b db.RatedGameBrief) error {
+			if b.Termination == chego.Unterminated {
+				return nil
+			}
+			g, err := selectGame(b.Id)
+			if err != nil {
+				return err
+			}
+			return game.WriteRatedPGN(rw, g, isCasual)
+		}
+	}
+
+	err := exportPages(rw, id, s.gameRepo.SelectNewestRated,
+		s.gameRepo.SelectOlderRated, ratedCursor, writeRated(false))
+	if err == nil {
+		err = exportPages(rw, id, s.gameRepo.SelectNewestCasual,
+			s.gameRepo.SelectOlderCasual, ratedCursor, writeRated(true))
+	}
+	if err == nil {
+		err = exportPages(rw, id, s.gameRepo.SelectNewestEngine,
+			s.gameRepo.SelectOlderEngine, engineCursor,
+			func(b db.EngineGameBrief) error {
+				if b.Termination == chego.Unterminated {
+					return nil
+				}
+				g, err := s.gameRepo.SelectEngine(b.Id)
+				if err != nil {
+					return err
+				}
+				return game.WriteEnginePGN(rw, g)
+			})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// exportPages selects the player's games page by page using the cursor of the
+// last game on the page and writes each of them.  The response is flushed after
+// each page.
+func exportPages[B any](
+	rw http.ResponseWriter, id string,
+	newest func(string) ([]B, error),
+	older func(string, db.Pagination) ([]B, error),
+	cursor func(B) db.Pagination,
+	write func(B) error,
+) error {
+	page, err := newest(id)
+	for err == nil && len(page) > 0 {
+		for _, b := range page {
+			if err = write(b); err != nil {
+				return err
+			}
+		}
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+		page, err = older(id, cursor(page[len(page)-1]))
+	}
+	return err
+}
+
+func ratedCursor(b db.RatedGameBrief) db.Pagination {
+	return db.Pagination{CursorCreatedAt: b.CreatedAt, CursorId: b.Id}
+}
+
+func engineCursor(b db.EngineGameBrief) db.Pagination {
+	return db.Pagination{CursorCreatedAt: b.CreatedAt, CursorId: b.Id}
+}
+
+// importGames stores the games uploaded by the player as the "pgn" file of the
+// multipart form and redirects the player to its profile.  Games are imported
+// only if all of them are valid.  The request will be denied in the following
+// cases:
+//   - The player is a guest;
+//   - The file is missing or too large;
+//   - The file contains too many games or any malformed game.
+func (s Service) importGames(rw http.ResponseWriter, r *http.Request) {
+	p, ok := r.Context().Value(auth.PlayerKey).(db.Player)
+	if !ok {
+		log.Print("request context is broken")
+		return
+	}
+	if p.IsGuest {
+		http.Error(rw, msgSignupToImport, http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(rw, r.Body, maxImportSize)
+	f, _, err := r.FormFile("pgn")
+	if err != nil {
+		http.Error(rw, msgBadRequest, http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(rw, msgBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	games, err := game.ParsePGN(string(raw), maxImportedGames)
+	if errors.Is(err, game.ErrTooManyGames) {
+		http.Error(rw, msgTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for i := range games {
+		games[i].Id = randgen.GenId(randgen.IdLen)
+		games[i].PlayerId = p.Id
+	}
+	if err = s.gameRepo.InsertImported(games); err != nil {
+		log.Print(err)
+		http.Error(rw, msgDBError, http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(rw, r, "/player/"+p.Id, http.StatusSeeOther)
+}
+
+// importedGame serves the imported game with the same page as rated games.
+func (s Service) importedGame(rw http.ResponseWriter, r *http.Request) {
+	g, err := s.gameRepo.SelectImported(r.PathValue("id"))
+	if err != nil {
+		s.renderPage(rw, "/error", msgNotFound)
+		return
+	}
+
+	s.renderPage(rw, "/rated", db.RatedGame{
+		CreatedAt:   g.CreatedAt,
+		White:       db.Player{Name: g.White},
+		Black:       db.Player{Name: g.Black},
+		Moves:       g.Moves,
+		Id:          g.Id,
+		MovesLength: g.MovesLength,
+		Result:      g.Result,
+	})
+}
+
+// importedGames responds with the briefs of the games imported by the player
+// encoded as JSON.  Older games are selected if the cursor of the last game is
+// specified with the "cca" and "cid" query parameters.
+func (s Service) importedGames(rw http.ResponseWriter, r *http.Request) {
+	id, q := r.PathValue("id"), r.URL.Query()
+
+	var games []db.ImportedGameBrief
+	var err error
+	if q.Has("cid") {
+		var p db.Pagination
+		p.CursorId = q.Get("cid")
+		p.CursorCreatedAt, err = time.Parse(time.RFC3339Nano, q.Get("cca"))
+		if err != nil {
+			http.Error(rw, msgBadRequest, http.StatusBadRequest)
+			return
+		}
+		games, err = s.gameRepo.SelectOlderImported(id, p)
+	} else {
+		games, err = s.gameRepo.SelectNewestImported(id)
+	}
+	if err != nil {
+		http.Error(rw, msgDBError, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(games); err != nil {
+		log.Print(err)
+	}
+}
+
+// setPGNHeaders makes the browser download the PGN file with the specified
+// name.
+func setPGNHeaders(rw http.ResponseWriter, name string) {
+	rw.Header().Set("Content-Type", "application/x-chess-pgn")
+	rw.Header().Set("Content-Disposition", `attachment; filename="`+name+`.pgn"`)
+}
+
+// invitation serves the page of the open invitation.  The invitation itself is
+// hosted by the WebSocket room with the same id.
+func (s Service) invitation(rw http.ResponseWriter, r *http.Request) {
+	s.renderPage(rw, "/invite", r.PathValue("id"))
+}
+
+// engineGame serves the game page or the game in PGN if the id has the ".pgn"
+// suffix.
 func (s Service) engineGame(rw http.ResponseWriter, r *http.Request) {
-	game, err := s.gameRepo.SelectEngine(r.PathValue("id"))
+	id, isPGN := strings.CutSuffix(r.PathValue("id"), ".pgn")
+	g, err := s.gameRepo.SelectEngine(id)
 	if err != nil {
 		s.renderPage(rw, "/error", msgNotFound)
 		return
 	}
-	s.renderPage(rw, "/engine", game)
+
+	if isPGN {
+		// Only terminated games are exported, same as in the export list.
+		if g.Termination == chego.Unterminated {
+			http.Error(rw, msgNotFound, http.StatusNotFound)
+			return
+		}
+		setPGNHeaders(rw, id)
+		if err = game.WriteEnginePGN(rw, g); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	s.renderPage(rw, "/engine", g)
 }
 
+// ratedGame serves the game page or the game in PGN if the id has the ".pgn"
+// suffix.
 func (s Service) ratedGame(rw http.ResponseWriter, r *http.Request) {
-	game, err := s.gameRepo.SelectEngine(r.PathValue("id"))
+	id, isPGN := strings.CutSuffix(r.PathValue("id"), ".pgn")
+	g, err := s.gameRepo.SelectRated(id)
+	if err != nil {
+		s.renderPage(rw, "/error", msgNotFound)
+		return
+	}
+
+	if isPGN {
+		if g.Termination == chego.Unterminated {
+			http.Error(rw, msgNotFound, http.StatusNotFound)
+			return
+		}
+		setPGNHeaders(rw, id)
+		if err = game.WriteRatedPGN(rw, g, false); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	s.renderPage(rw, "/rated", g)
+}
+
+func (s Service) casualGame(rw http.ResponseWriter, r *http.Request) {
+	game, err := s.gameRepo.SelectCasual(r.PathValue("id"))
+	if err != nil {
+		s.renderPage(rw, "/error", msgNotFound)
+		return
+	}
+	s.renderPage(rw, "/casual", game)
+}
+
+func (s Service) correspondenceGame(rw http.ResponseWriter, r *http.Request) {
+	game, err := s.gameRepo.SelectCorrespondence(r.PathValue("id"))
 	if err != nil {
 		s.renderPage(rw, "/error", msgNotFound)
 		return
 	}
-	s.renderPage(rw, "/rated", game)
+	s.renderPage(rw, "/correspondence", game)
 }
 
 func (s Service) queue(rw http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,331 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"justchess/internal/auth"
+	"justchess/internal/db"
+	"justchess/internal/event"
+	"justchess/internal/position"
+	"justchess/internal/randgen"
+)
+
+const (
+	msgChallengeFailed = "The challenge is no longer available"
+	msgPlayerNotFound  = "There is no registered player with the specified id"
+	msgSignupToRated   = "Please, sign up to play rated games"
+	msgGuestOpponent   = "Guest players cannot be challenged"
+
+	// How long the challenge stays pending.
+	challengeTTL = 2 * time.Minute
+)
+
+// ColorPreference is the side chosen by the challenger.
+type ColorPreference int
+
+const (
+	RandomColor ColorPreference = iota
+	WhiteColor
+	BlackColor
+)
+
+// challenge is an invitation to play a game with the specified player.
+type challenge struct {
+	ExpiresAt  time.Time       `json:"e"`
+	Challenger db.Player       `json:"-"`
+	Opponent   db.Player       `json:"-"`
+	Id         string          `json:"i"`
+	Name       string          `json:"n"`
+	Control    int             `json:"c"`
+	Color      ColorPreference `json:"cl"`
+	FEN        string          `json:"f,omitempty"`
+	IsRated    bool            `json:"r"`
+}
+
+// assign returns the white and the black player according to the preference
+// of the first one.
+func (pref ColorPreference) assign(p, opponent db.Player) (db.Player, db.Player) {
+	if pref == BlackColor || (pref == RandomColor && rand.IntN(2) == 1) {
+		return opponent, p
+	}
+	return p, opponent
+}
+
+// gameRequest describes the game requested by the challenger or the creator of
+// the invitation.
+type gameRequest struct {
+	Control int             `json:"c"`
+	Color   ColorPreference `json:"cl"`
+	// FEN of the starting position.  Empty for the standard one.
+	FEN     string `json:"f,omitempty"`
+	IsRated bool   `json:"r"`
+}
+
+// isValid reports whether the request is well-formed.  Games from custom
+// positions can only be casual, since the rated game could be started from the
+// won position.
+func (r gameRequest) isValid() bool {
+	return r.Control >= 0 && r.Control < len(controls) &&
+		r.Color >= RandomColor && r.Color <= BlackColor &&
+		(len(r.FEN) == 0 || (!r.IsRated && position.Validate(r.FEN) == nil))
+}
+
+// challengeRequest is the request body of the issued challenge.
+type challengeRequest struct {
+	gameRequest
+	OpponentId string `json:"o"`
+}
+
+// challengeHub stores pending challenges and notifies connected players about
+// them.  Players connect to the hub to receive challenges while browsing the
+// site.
+type challengeHub struct {
+	gameRepo   db.GameRepo
+	playerRepo db.PlayerRepo
+	clients    map[string]*client
+	challenges map[string]challenge
+	create     chan createRoomPayload
+	issue      chan challenge
+	register   chan *client
+	unregister chan string
+	handle     chan event.Event
+	ticker     *time.Ticker
+}
+
+func newChallengeHub(create chan createRoomPayload, gr db.GameRepo,
+	pr db.PlayerRepo,
+) challengeHub {
+	return challengeHub{
+		gameRepo:   gr,
+		playerRepo: pr,
+		clients:    make(map[string]*client),
+		challenges: make(map[string]challenge),
+		create:     create,
+		issue:      make(chan challenge),
+		register:   make(chan *client),
+		unregister: make(chan string),
+		handle:     make(chan event.Event),
+		ticker:     time.NewTicker(time.Second),
+	}
+}
+
+// listenEvents handles challenges until the context is canceled.  Pending
+// challenges are lost on shutdown.
+func (h challengeHub) listenEvents(ctx context.Context) {
+	defer h.ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, c := range h.clients {
+				c.disconnect(event.JSON(event.Error, msgShutdown))
+			}
+			return
+
+		case c := <-h.register:
+			h.add(c)
+
+		case id := <-h.unregister:
+			delete(h.clients, id)
+
+		case ch := <-h.issue:
+			// The repeated challenge replaces the pending one.
+			for id, pending := range h.challenges {
+				if pending.Challenger.Id == ch.Challenger.Id &&
+					pending.Opponent.Id == ch.Opponent.Id {
+					delete(h.challenges, id)
+				}
+			}
+			h.challenges[ch.Id] = ch
+			h.notify(ch.Opponent.Id, event.Challenge, ch)
+
+		case e := <-h.handle:
+			var id string
+			if err := json.Unmarshal(e.Payload, &id); err != nil {
+				continue
+			}
+
+			switch e.Kind {
+			case event.ChallengeAccept:
+				h.accept(ctx, e.SenderId, id)
+			case event.ChallengeDecline:
+				h.decline(e.SenderId, id)
+			}
+
+		case <-h.ticker.C:
+			for id, ch := range h.challenges {
+				if time.Now().After(ch.ExpiresAt) {
+					delete(h.challenges, id)
+					h.notify(ch.Challenger.Id, event.ChallengeExpire, id)
+					h.notify(ch.Opponent.Id, event.ChallengeExpire, id)
+				}
+			}
+		}
+	}
+}
+
+// add registers the client and sends the challenges it has received.
+func (h challengeHub) add(c *client) {
+	if len(h.clients) == clientsThreshold {
+		c.send <- event.JSON(event.Error, msgTooMany)
+		return
+	}
+	if _, exists := h.clients[c.player.Id]; exists {
+		c.send <- event.JSON(event.Error, msgConflict)
+		return
+	}
+
+	c.forward = h.handle
+	c.unregister = h.unregister
+	h.clients[c.player.Id] = c
+
+	for _, ch := range h.challenges {
+		if ch.Opponent.Id == c.player.Id {
+			c.mustSend(event.JSON(event.Challenge, ch))
+		}
+	}
+}
+
+// accept spawns the game and redirects both players to it.  Challenge will be
+// discarded if it doesn't exist or the sender is not the challenged player.
+func (h challengeHub) accept(ctx context.Context, senderId, id string) {
+	ch, exists := h.challenges[id]
+	if !exists || ch.Opponent.Id != senderId {
+		h.notify(senderId, event.Error, msgChallengeFailed)
+		return
+	}
+	delete(h.challenges, id)
+
+	white, black := ch.Color.assign(ch.Challenger, ch.Opponent)
+
+	roomId := randgen.GenId(randgen.IdLen)
+	g, url, err := spawnGame(
+		white, black, controls[ch.Control], ch.IsRated, ch.FEN,
+		roomId, h.gameRepo, h.playerRepo,
+	)
+	if err != nil {
+		log.Print(err)
+		h.notify(senderId, event.Error, msgRoomCreationFailed)
+		return
+	}
+
+	if !requestRoom(ctx, h.create, createRoomPayload{
+		id:   roomId,
+		game: g,
+		res:  make(chan struct{}, 1),
+	}) {
+		g.Abandon()
+		return
+	}
+	h.notify(ch.Challenger.Id, event.Redirect, url)
+	h.notify(ch.Opponent.Id, event.Redirect, url)
+}
+
+func (h challengeHub) decline(senderId, id string) {
+	ch, exists := h.challenges[id]
+	if !exists || ch.Opponent.Id != senderId {
+		return
+	}
+	delete(h.challenges, id)
+	h.notify(ch.Challenger.Id, event.ChallengeDecline, id)
+}
+
+// notify sends the event to the player if it's connected to the hub.
+func (h challengeHub) notify(playerId string, k event.Kind, p any) {
+	if c, exists := h.clients[playerId]; exists {
+		c.mustSend(event.JSON(k, p))
+	}
+}
+
+// issueChallenge handles challenge requests.  The request will be denied in
+// the following cases:
+//   - The request body is malformed, the time control doesn't exist or the
+//     starting position is invalid;
+//   - The opponent is a guest, doesn't exist, or is the challenger;
+//   - The challenger is a guest and the challenge is rated.
+//
+// The challenger must be connected to the hub to be redirected to the game once
+// the challenge is accepted.
+func (s Service) issueChallenge(rw http.ResponseWriter, r *http.Request) {
+	p, ok := r.Context().Value(auth.PlayerKey).(db.Player)
+	if !ok {
+		log.Print("request context is broken")
+		return
+	}
+
+	var req challengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		!req.isValid() || req.OpponentId == p.Id {
+		http.Error(rw, msgBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	if p.IsGuest && req.IsRated {
+		http.Error(rw, msgSignupToRated, http.StatusForbidden)
+		return
+	}
+
+	opponent, err := s.playerRepo.SelectById(
+		req.OpponentId, controls[req.Control].Category(),
+	)
+	if err != nil {
+		http.Error(rw, msgPlayerNotFound, http.StatusNotFound)
+		return
+	}
+	if opponent.IsGuest {
+		http.Error(rw, msgGuestOpponent, http.StatusForbidden)
+		return
+	}
+
+	ch := challenge{
+		ExpiresAt:  time.Now().Add(challengeTTL),
+		Challenger: p,
+		Opponent:   opponent,
+		Id:         randgen.GenId(randgen.IdLen),
+		Name:       p.Name,
+		Control:    req.Control,
+		Color:      req.Color,
+		FEN:        req.FEN,
+		IsRated:    req.IsRated,
+	}
+	select {
+	case s.challenges.issue <- ch:
+		rw.WriteHeader(http.StatusAccepted)
+	case <-s.closed:
+		http.Error(rw, msgShutdown, http.StatusServiceUnavailable)
+	}
+}
+
+// challengeHandshake connects the client to the challenge hub.
+func (s Service) challengeHandshake(rw http.ResponseWriter, r *http.Request) {
+	p, ok := r.Context().Value(auth.PlayerKey).(db.Player)
+	if !ok {
+		log.Print("request context is broken")
+		return
+	}
+
+	if s.isClosed() {
+		http.Error(rw, msgShutdown, http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		// Simply return here since the upgrader writes the response.
+		return
+	}
+	c := newClient(conn, p)
+	go c.read()
+	go c.write()
+
+	select {
+	case s.challenges.register <- c:
+	case <-s.closed:
+		c.disconnect(event.JSON(event.Error, msgShutdown))
+	}
+}
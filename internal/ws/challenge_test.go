@@ -0,0 +1,155 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"justchess/internal/auth"
+	"justchess/internal/db"
+	"justchess/internal/event"
+)
+
+func TestDecline(t *testing.T) {
+	cases := []struct {
+		senderId   string
+		expected   int
+		isResolved bool
+	}{
+		// Only the challenged player may decline.
+		{"challenger", 0, false},
+		{"stranger", 0, false},
+		{"opponent", 1, true},
+	}
+
+	for i, tc := range cases {
+		h := newChallengeHub(nil, stubRepo{}, nil)
+		challenger := &client{
+			player: db.Player{Id: "challenger"}, send: make(chan []byte, 1),
+		}
+		h.clients[challenger.player.Id] = challenger
+		h.challenges["c"] = challenge{
+			Challenger: challenger.player,
+			Opponent:   db.Player{Id: "opponent"},
+			Id:         "c",
+		}
+
+		h.decline(tc.senderId, "c")
+
+		if len(challenger.send) != tc.expected {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.expected, len(challenger.send))
+		}
+		if _, exists := h.challenges["c"]; exists == tc.isResolved {
+			t.Fatalf("case %d: expected resolved: %v", i, tc.isResolved)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	h := newChallengeHub(nil, stubRepo{}, nil)
+	h.ticker.Reset(time.Millisecond)
+
+	c := &client{player: db.Player{Id: "opponent"}, send: make(chan []byte, 2)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.listenEvents(ctx)
+
+	h.register <- c
+	h.issue <- challenge{
+		ExpiresAt:  time.Now().Add(10 * time.Millisecond),
+		Challenger: db.Player{Id: "challenger"},
+		Opponent:   c.player,
+		Id:         "c",
+	}
+
+	for _, k := range []event.Kind{event.Challenge, event.ChallengeExpire} {
+		var e event.Event
+		select {
+		case raw := <-c.send:
+			if err := json.Unmarshal(raw, &e); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected: %d, got nothing", k)
+		}
+		if e.Kind != k {
+			t.Fatalf("expected: %d, got: %d", k, e.Kind)
+		}
+	}
+}
+
+func TestGameRequest(t *testing.T) {
+	const fen = "4k3/8/8/8/8/8/8/QQQQKQQQ w - - 0 1"
+
+	cases := []struct {
+		req      gameRequest
+		expected bool
+	}{
+		{gameRequest{Control: 0, IsRated: true}, true},
+		{gameRequest{Control: len(controls)}, false},
+		{gameRequest{Color: BlackColor + 1}, false},
+		// Rated games cannot start from custom positions.
+		{gameRequest{FEN: fen, IsRated: true}, false},
+		{gameRequest{FEN: "8/8/8/8/8/8/8/8 w - - 0 1"}, false},
+	}
+
+	for i, tc := range cases {
+		if got := tc.req.isValid(); got != tc.expected {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+	}
+}
+
+// playerRepo selects the players from the map.  Other methods must not be
+// called.
+type playerRepo struct {
+	db.PlayerRepo
+	players map[string]db.Player
+}
+
+func (r playerRepo) SelectById(id string, _ db.Category) (db.Player, error) {
+	p, ok := r.players[id]
+	if !ok {
+		return p, sql.ErrNoRows
+	}
+	return p, nil
+}
+
+func TestIssueChallenge(t *testing.T) {
+	cases := []struct {
+		challenger db.Player
+		body       string
+		expected   int
+	}{
+		{db.Player{Id: "challenger"}, `{"o":"opponent","r":true}`, http.StatusAccepted},
+		{db.Player{Id: "challenger"}, `{"o":"challenger"}`, http.StatusBadRequest},
+		{db.Player{Id: "challenger"}, `{"o":"stranger"}`, http.StatusNotFound},
+		{db.Player{Id: "challenger", IsGuest: true}, `{"o":"opponent","r":true}`, http.StatusForbidden},
+		// Guests cannot be challenged to rated nor casual games.
+		{db.Player{Id: "challenger"}, `{"o":"guest","r":true}`, http.StatusForbidden},
+		{db.Player{Id: "challenger"}, `{"o":"guest"}`, http.StatusForbidden},
+	}
+
+	for i, tc := range cases {
+		s := NewService(stubRepo{}, playerRepo{players: map[string]db.Player{
+			"opponent": {Id: "opponent"},
+			"guest":    {Id: "guest", IsGuest: true},
+		}}, nil)
+		// The hub accepts the issued challenge.
+		go func() { <-s.challenges.issue }()
+
+		r := httptest.NewRequest(http.MethodPost, "/challenge", strings.NewReader(tc.body))
+		r = r.WithContext(context.WithValue(r.Context(), auth.PlayerKey, tc.challenger))
+		rw := httptest.NewRecorder()
+		s.issueChallenge(rw, r)
+
+		if rw.Code != tc.expected {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.expected, rw.Code)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"log"
+	"sync"
+
+	"justchess/internal/db"
+)
+
+// checkpointTask is the latest checkpoint of the room which isn't stored yet.
+type checkpointTask struct {
+	checkpoint db.Checkpoint
+	// Whether the stored checkpoint must be deleted, e.g. after the game is
+	// terminated.
+	isDeleted bool
+}
+
+// checkpointWriter stores checkpoints in the background, so rooms don't wait
+// for the repository.  Only the latest pending checkpoint of each room is
+// stored, thus slow writes don't pile up.
+type checkpointWriter struct {
+	mu       *sync.Mutex
+	pending  map[string]checkpointTask
+	wake     chan struct{}
+	gameRepo db.GameRepo
+}
+
+func newCheckpointWriter(gr db.GameRepo) checkpointWriter {
+	return checkpointWriter{
+		mu:       new(sync.Mutex),
+		pending:  make(map[string]checkpointTask),
+		wake:     make(chan struct{}, 1),
+		gameRepo: gr,
+	}
+}
+
+// submit replaces the pending checkpoint of the room.  Never blocks.
+func (w checkpointWriter) submit(id string, t checkpointTask) {
+	w.mu.Lock()
+	w.pending[id] = t
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// listenEvents stores the submitted checkpoints until the stop channel is
+// closed.  Then it stores the ones which are still pending and returns.
+func (w checkpointWriter) listenEvents(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			w.flush()
+			return
+		case <-w.wake:
+			w.flush()
+		}
+	}
+}
+
+// flush stores the pending checkpoints one by one.  Checkpoints submitted
+// during the write replace the pending ones.
+func (w checkpointWriter) flush() {
+	for {
+		w.mu.Lock()
+		var (
+			id string
+			t  checkpointTask
+		)
+		for id, t = range w.pending {
+			break
+		}
+		delete(w.pending, id)
+		w.mu.Unlock()
+
+		if len(id) == 0 {
+			return
+		}
+
+		var err error
+		if t.isDeleted {
+			err = w.gameRepo.DeleteCheckpoint(id)
+		} else {
+			err = w.gameRepo.UpsertCheckpoint(t.checkpoint)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
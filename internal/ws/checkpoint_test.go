@@ -0,0 +1,48 @@
+package ws
+
+import (
+	"testing"
+
+	"justchess/internal/db"
+)
+
+// checkpointRepo records the stored and deleted checkpoints.
+type checkpointRepo struct {
+	db.GameRepo
+	stored  map[string]string
+	deleted map[string]bool
+}
+
+func (r checkpointRepo) UpsertCheckpoint(c db.Checkpoint) error {
+	r.stored[c.Id] = string(c.State)
+	return nil
+}
+
+func (r checkpointRepo) DeleteCheckpoint(id string) error {
+	r.deleted[id] = true
+	return nil
+}
+
+func TestCheckpointWriter(t *testing.T) {
+	repo := checkpointRepo{stored: make(map[string]string), deleted: make(map[string]bool)}
+	w := newCheckpointWriter(repo)
+
+	// Checkpoints submitted before the write are coalesced.
+	for _, state := range []string{"1", "2", "3"} {
+		w.submit("a", checkpointTask{checkpoint: db.Checkpoint{Id: "a", State: []byte(state)}})
+	}
+	w.submit("b", checkpointTask{checkpoint: db.Checkpoint{Id: "b", State: []byte("1")}})
+	w.submit("b", checkpointTask{isDeleted: true})
+
+	// Pending checkpoints are stored on stop.
+	stop := make(chan struct{})
+	close(stop)
+	w.listenEvents(stop)
+
+	if len(repo.stored) != 1 || repo.stored["a"] != "3" {
+		t.Fatalf("expected: %v, got: %v", map[string]string{"a": "3"}, repo.stored)
+	}
+	if len(repo.deleted) != 1 || !repo.deleted["b"] {
+		t.Fatalf("expected: %v, got: %v", map[string]bool{"b": true}, repo.deleted)
+	}
+}
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"justchess/internal/db"
@@ -43,11 +44,22 @@ type client struct {
 	// from client.
 	pong chan struct{}
 	conn *websocket.Conn
-	// Network delay in milliseconds.
-	ping int
+	// Network delay in milliseconds.  Written by the write goroutine and read
+	// by the room to compensate the player's spent time, thus atomic.
+	ping atomic.Int64
 	// New ping event must be sent only when the client responses to the
 	// previous one.  Otherwise the delay cannot be correctly measured.
 	hasAnsweredPing bool
+	// Sequence number of the last event received by the reconnecting client.
+	lastSeq    uint64
+	isResuming bool
+	// Rating in the category of the queue.  Accessed only by the queue
+	// goroutine.
+	rating float64
+	// Delivery state.  Accessed only by the room or queue goroutine.
+	isStale    bool
+	isEvicted  bool
+	staleTicks int
 }
 
 // newClient creates a new client and sets the connection properties.
@@ -57,7 +69,6 @@ func newClient(conn *websocket.Conn, p db.Player) *client {
 		send:   make(chan []byte, 192),
 		pong:   make(chan struct{}, 10),
 		conn:   conn,
-		ping:   0,
 		// Must be true to be able to send the first ping message.
 		hasAnsweredPing: true,
 	}
@@ -107,6 +118,13 @@ func (c *client) write() {
 				c.conn.WriteMessage(websocket.CloseMessage, nil)
 				return
 			}
+			// Nil event is sent by [client.disconnect].
+			if raw == nil {
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				c.conn.Close()
+				return
+			}
 
 			if err := c.conn.WriteMessage(websocket.TextMessage, raw); err != nil {
 				continue
@@ -129,7 +147,7 @@ func (c *client) write() {
 
 			if err := c.conn.WriteJSON(event.Event{
 				Kind:    event.Ping,
-				Payload: []byte(strconv.Itoa(c.ping)),
+				Payload: []byte(strconv.FormatInt(c.ping.Load(), 10)),
 			}); err != nil {
 				continue
 			}
@@ -150,7 +168,7 @@ func (c *client) handlePong() error {
 	// Handle pong events only when the client has a pending ping event.
 	if !c.hasAnsweredPing {
 		c.hasAnsweredPing = true
-		c.ping = int(time.Since(c.pingTimestamp).Milliseconds())
+		c.ping.Store(time.Since(c.pingTimestamp).Milliseconds())
 		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	}
 	return nil
@@ -0,0 +1,138 @@
+package ws
+
+import (
+	"sync/atomic"
+
+	"justchess/internal/event"
+)
+
+// Number of seconds the stale client has to drain its send buffer before it
+// gets evicted.
+const evictDeadline = 5
+
+// Delivery counters shared by all rooms and queues.
+var (
+	droppedEvents   atomic.Int64
+	coalescedEvents atomic.Int64
+	evictedClients  atomic.Int64
+)
+
+// DeliveryStats describes how the events were delivered to slow clients since
+// the server start.
+type DeliveryStats struct {
+	// Events discarded due to the full send buffer.
+	Dropped int64
+	// Events which weren't sent to stale clients, since they are replaced by the
+	// game snapshot.
+	Coalesced int64
+	// Clients disconnected due to the persistently full send buffer.
+	Evicted int64
+}
+
+func (s Service) DeliveryStats() DeliveryStats {
+	return DeliveryStats{
+		Dropped:   droppedEvents.Load(),
+		Coalesced: coalescedEvents.Load(),
+		Evicted:   evictedClients.Load(),
+	}
+}
+
+// trySend sends the event to the client without blocking.  Returns false if the
+// client's send buffer is full.
+func (c *client) trySend(raw []byte) bool {
+	select {
+	case c.send <- raw:
+		return true
+	default:
+		return false
+	}
+}
+
+// drop sends the event which will be superseded by the next one, e.g.
+// [event.ClientsCounter].  The event is discarded if the buffer is full.
+func (c *client) drop(raw []byte) {
+	if !c.isEvicted && !c.trySend(raw) {
+		droppedEvents.Add(1)
+	}
+}
+
+// deliver sends the room event according to its kind.  Only moves are replaced
+// by the game snapshot, since ends of the game, offers, chat messages and
+// redirects aren't part of it.
+func (c *client) deliver(k event.Kind, raw []byte) {
+	if k == event.Move || k == event.Game {
+		c.resync(raw)
+		return
+	}
+	c.mustSend(raw)
+}
+
+// resync sends the game event.  If the buffer is full, the client is marked as
+// stale and further moves are discarded until the client receives the game
+// snapshot, which replaces the missed moves.
+func (c *client) resync(raw []byte) {
+	switch {
+	case c.isEvicted:
+	case c.isStale:
+		coalescedEvents.Add(1)
+	case !c.trySend(raw):
+		droppedEvents.Add(1)
+		c.isStale = true
+	}
+}
+
+// snapshot sends the game snapshot and clears the stale mark.  The client gets
+// evicted if it stays stale for longer than [evictDeadline] snapshot attempts.
+func (c *client) snapshot(raw []byte) {
+	if c.isEvicted {
+		return
+	}
+	if c.trySend(raw) {
+		c.isStale = false
+		c.staleTicks = 0
+		return
+	}
+
+	droppedEvents.Add(1)
+	c.isStale = true
+	if c.staleTicks++; c.staleTicks >= evictDeadline {
+		c.evict()
+	}
+}
+
+// mustSend sends the event which cannot be replaced, e.g. [event.Redirect].
+// The client is evicted if the buffer is full.
+func (c *client) mustSend(raw []byte) {
+	if !c.isEvicted && !c.trySend(raw) {
+		droppedEvents.Add(1)
+		c.evict()
+	}
+}
+
+// disconnect sends the final event, e.g. the shutdown notice, and asks the write
+// goroutine to close the connection once the event is written.  The client is
+// evicted if the buffer is full.
+func (c *client) disconnect(raw []byte) {
+	c.mustSend(raw)
+	c.mustSend(nil)
+}
+
+// evict closes the connection.  The client will be unregistered by its read
+// goroutine.
+func (c *client) evict() {
+	c.isEvicted = true
+	evictedClients.Add(1)
+	c.conn.Close()
+}
+
+// broadcastGame numbers the game snapshot and sends it to every player and to
+// spectators after the delay.  The snapshot is kept for reconnecting clients,
+// since it replaces the position which cannot be restored from the moves, e.g.
+// after the takeback.
+func (r room) broadcastGame() {
+	raw := r.replay.push(event.Game, r.game.GamePayload(), "")
+	for _, c := range r.clients {
+		c.snapshot(raw)
+	}
+	r.pushSpectators(event.Game, raw)
+}
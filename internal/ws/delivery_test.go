@@ -0,0 +1,167 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+	"justchess/internal/event"
+
+	"github.com/gorilla/websocket"
+)
+
+// dial returns the server side of a new WebSocket connection along with the
+// peer.
+func dial(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return <-conns, peer
+}
+
+func TestStalledClient(t *testing.T) {
+	conn, peer := dial(t)
+	// The write goroutine isn't started, so the client never drains the buffer.
+	slow := newClient(conn, db.Player{Id: "slow"})
+	fast := &client{player: db.Player{Id: "fast"}, send: make(chan []byte, 256)}
+
+	r := newRoom("room", stubGame{}, stubRepo{})
+	r.clients[slow.player.Id] = slow
+	r.clients[fast.player.Id] = fast
+
+	for len(slow.send) < cap(slow.send) {
+		slow.send <- event.JSON(event.Chat, "")
+	}
+
+	before := DeliveryStats{
+		Dropped:   droppedEvents.Load(),
+		Coalesced: coalescedEvents.Load(),
+		Evicted:   evictedClients.Load(),
+	}
+
+	// Broadcasts must not block on the stalled client.
+	done := make(chan struct{})
+	go func() {
+		for range 3 {
+			r.broadcast(event.Move, nil)
+		}
+		r.broadcastCounter()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast is blocked by the stalled client")
+	}
+
+	// Three moves along with the players and spectators counters.
+	if len(fast.send) != 5 {
+		t.Fatalf("expected: %d, got: %d", 5, len(fast.send))
+	}
+	if !slow.isStale {
+		t.Fatal("stalled client isn't marked as stale")
+	}
+	if d := droppedEvents.Load() - before.Dropped; d != 3 {
+		t.Fatalf("dropped: expected: %d, got: %d", 3, d)
+	}
+	if c := coalescedEvents.Load() - before.Coalesced; c != 2 {
+		t.Fatalf("coalesced: expected: %d, got: %d", 2, c)
+	}
+
+	// The stalled client is evicted if it doesn't recover.
+	for range evictDeadline {
+		r.resyncStale()
+	}
+	if !slow.isEvicted || evictedClients.Load()-before.Evicted != 1 {
+		t.Fatal("stalled client isn't evicted")
+	}
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := peer.ReadMessage(); err == nil {
+		t.Fatal("connection of the evicted client isn't closed")
+	}
+}
+
+func TestRecoveredClient(t *testing.T) {
+	c := &client{player: db.Player{Id: "slow"}, send: make(chan []byte, 1)}
+	r := newRoom("room", stubGame{}, stubRepo{})
+	r.clients[c.player.Id] = c
+
+	r.broadcast(event.Move, nil)
+	r.broadcast(event.Move, nil)
+	if !c.isStale {
+		t.Fatal("client isn't marked as stale")
+	}
+
+	// The missed event is replaced by the game snapshot.
+	<-c.send
+	r.resyncStale()
+	if c.isStale || c.isEvicted || len(c.send) != 1 {
+		t.Fatal("client isn't resynchronized")
+	}
+}
+
+func TestStaleClientEnd(t *testing.T) {
+	c := &client{player: db.Player{Id: "slow"}, send: make(chan []byte, 1)}
+	r := newRoom("room", stubGame{}, stubRepo{})
+	r.clients[c.player.Id] = c
+
+	r.broadcast(event.Move, nil)
+	r.broadcast(event.Move, nil)
+	if !c.isStale {
+		t.Fatal("client isn't marked as stale")
+	}
+
+	// The end of the game isn't part of the snapshot, thus it must not be
+	// coalesced with the missed moves.
+	<-c.send
+	r.broadcast(event.End, nil)
+	if len(c.send) != 1 || c.isEvicted {
+		t.Fatal("end of the game isn't sent to the stale client")
+	}
+	var e event.Event
+	if err := json.Unmarshal(<-c.send, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != event.End {
+		t.Fatalf("expected: %d, got: %d", event.End, e.Kind)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	conn, peer := dial(t)
+	c := newClient(conn, db.Player{Id: "player"})
+	go c.write()
+
+	c.disconnect(event.JSON(event.Error, msgShutdown))
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var e event.Event
+	if err := peer.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != event.Error {
+		t.Fatalf("expected: %d, got: %d", event.Error, e.Kind)
+	}
+	// The connection is closed only after the final event is written.
+	if _, _, err := peer.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected: connection close, got: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"justchess/internal/auth"
+	"justchess/internal/db"
+	"justchess/internal/event"
+	"justchess/internal/game"
+	"justchess/internal/randgen"
+
+	"github.com/treepeck/chego"
+)
+
+const (
+	msgInvitationExpired = "The invitation has expired"
+
+	// How long the invitation stays open.
+	invitationTTL = 10 * time.Minute
+)
+
+// invitation is the open invitation to the game which is hosted by the room
+// until the first authorized visitor other than its creator claims it.  The
+// creator may cancel the invitation by resigning.
+type invitation struct {
+	creator    db.Player
+	gameRepo   db.GameRepo
+	playerRepo db.PlayerRepo
+	expiresAt  time.Time
+	request    gameRequest
+	isExpired  bool
+}
+
+func newInvitation(creator db.Player, req gameRequest, gr db.GameRepo,
+	pr db.PlayerRepo,
+) *invitation {
+	return &invitation{
+		creator:    creator,
+		gameRepo:   gr,
+		playerRepo: pr,
+		expiresAt:  time.Now().Add(invitationTTL),
+		request:    req,
+	}
+}
+
+func (inv *invitation) Play(string, byte, int) (game.MovePayload, bool) {
+	return game.MovePayload{}, false
+}
+func (inv *invitation) Join(string)             {}
+func (inv *invitation) Leave(string)            {}
+func (inv *invitation) IsPlayer(id string) bool { return id == inv.creator.Id }
+
+func (inv *invitation) TimeTick() {
+	if time.Now().After(inv.expiresAt) {
+		inv.isExpired = true
+	}
+}
+
+func (inv *invitation) Resign(id string) bool {
+	if id != inv.creator.Id || inv.isExpired {
+		return false
+	}
+	inv.isExpired = true
+	return true
+}
+
+func (inv *invitation) GamePayload() game.GamePayload { return game.GamePayload{} }
+
+func (inv *invitation) EndPayload() game.EndPayload {
+	if inv.isExpired {
+		return game.EndPayload{Termination: chego.Abandoned}
+	}
+	return game.EndPayload{Termination: chego.Unterminated}
+}
+
+func (inv *invitation) Abandon() { inv.isExpired = true }
+
+// claim spawns the game of the invitation if the client is its first visitor
+// other than the creator.  The game is hosted by the same room and both players
+// are redirected to it.  Returns false if the client must be added to the room
+// as usual.
+func (r *room) claim(c *client) bool {
+	inv, ok := r.game.(*invitation)
+	if !ok || inv.IsPlayer(c.player.Id) {
+		return false
+	}
+
+	if inv.isExpired {
+		c.send <- event.JSON(event.Error, msgInvitationExpired)
+		return true
+	}
+	if c.player.IsGuest && inv.request.IsRated {
+		// Redirect guest players to signup page.
+		c.send <- event.JSON(event.Redirect, "/signup")
+		return true
+	}
+
+	white, black := inv.request.Color.assign(inv.creator, c.player)
+	g, url, err := spawnGame(
+		white, black, controls[inv.request.Control], inv.request.IsRated,
+		inv.request.FEN, r.id, inv.gameRepo, inv.playerRepo,
+	)
+	if err != nil {
+		log.Print(err)
+		c.send <- event.JSON(event.Error, msgRoomCreationFailed)
+		return true
+	}
+
+	r.game = g
+	// Players reconnect to the room after the redirect.
+	r.timeToLive = emptyDeadline
+	c.send <- event.JSON(event.Redirect, url)
+	if creator := r.clients[inv.creator.Id]; creator != nil {
+		creator.mustSend(event.JSON(event.Redirect, url))
+	}
+	return true
+}
+
+// createInvitation handles requests to create the invitation and redirects
+// the creator to its page.  The link of the page can be shared with the
+// opponent.  The request will be denied if the body is malformed or the guest
+// player requests a rated game.
+func (s Service) createInvitation(rw http.ResponseWriter, r *http.Request) {
+	p, ok := r.Context().Value(auth.PlayerKey).(db.Player)
+	if !ok {
+		log.Print("request context is broken")
+		return
+	}
+
+	var req gameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.isValid() {
+		http.Error(rw, msgBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	if p.IsGuest && req.IsRated {
+		http.Error(rw, msgSignupToRated, http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := s.withClosed(r.Context())
+	defer cancel()
+	id := randgen.GenId(randgen.IdLen)
+	if !requestRoom(ctx, s.create, createRoomPayload{
+		id:   id,
+		game: newInvitation(p, req, s.gameRepo, s.playerRepo),
+		res:  make(chan struct{}, 1),
+	}) {
+		http.Error(rw, msgShutdown, http.StatusServiceUnavailable)
+		return
+	}
+
+	http.Redirect(rw, r, "/invite/"+id, http.StatusFound)
+}
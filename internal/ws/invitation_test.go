@@ -0,0 +1,126 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+
+	"justchess/internal/db"
+	"justchess/internal/event"
+)
+
+func TestClaim(t *testing.T) {
+	creator := db.Player{Id: "creator"}
+	cases := []struct {
+		player    db.Player
+		isRated   bool
+		isExpired bool
+		isClaimed bool
+		expected  event.Kind
+	}{
+		// The creator joins the room as usual.
+		{creator, false, false, false, 0},
+		{db.Player{Id: "guest", IsGuest: true}, true, false, true, event.Redirect},
+		{db.Player{Id: "late"}, false, true, true, event.Error},
+	}
+
+	for i, tc := range cases {
+		inv := newInvitation(creator, gameRequest{IsRated: tc.isRated}, stubRepo{}, nil)
+		inv.isExpired = tc.isExpired
+		r := newRoom("room", inv, stubRepo{})
+		c := &client{player: tc.player, send: make(chan []byte, 1)}
+
+		if got := r.claim(c); got != tc.isClaimed {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.isClaimed, got)
+		}
+		if !tc.isClaimed {
+			continue
+		}
+
+		var e event.Event
+		if err := json.Unmarshal(<-c.send, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Kind != tc.expected {
+			t.Fatalf("case %d: expected: %d, got: %d", i, tc.expected, e.Kind)
+		}
+		if r.game != inv {
+			t.Fatalf("case %d: game is spawned", i)
+		}
+	}
+}
+
+// spawnRepo records the inserted games.  Other methods must not be called.
+type spawnRepo struct {
+	stubRepo
+	inserted map[string]bool
+}
+
+func (r spawnRepo) InsertCasual(_, _, _ string, _ db.TimeControl, _ string) error {
+	r.inserted["casual"] = true
+	return nil
+}
+
+func (r spawnRepo) InsertRated(_, _, _ string, _ db.TimeControl, _ string) error {
+	r.inserted["rated"] = true
+	return nil
+}
+
+func TestClaimSpawn(t *testing.T) {
+	creator, opponent := db.Player{Id: "creator"}, db.Player{Id: "opponent"}
+	pr := playerRepo{players: map[string]db.Player{
+		creator.Id: creator, opponent.Id: opponent,
+	}}
+
+	cases := []struct {
+		isRated  bool
+		kind     string
+		expected string
+	}{
+		{false, "casual", "/casual/room"},
+		{true, "rated", "/rated/room"},
+	}
+
+	for i, tc := range cases {
+		gr := spawnRepo{inserted: make(map[string]bool)}
+		inv := newInvitation(creator, gameRequest{IsRated: tc.isRated}, gr, pr)
+		r := newRoom("room", inv, gr)
+		creatorClient := &client{player: creator, send: make(chan []byte, 1)}
+		r.clients[creator.Id] = creatorClient
+		c := &client{player: opponent, send: make(chan []byte, 1)}
+
+		if !r.claim(c) {
+			t.Fatalf("case %d: invitation isn't claimed", i)
+		}
+		if !gr.inserted[tc.kind] || len(gr.inserted) != 1 {
+			t.Fatalf("case %d: expected: %s game, got: %v", i, tc.kind, gr.inserted)
+		}
+		if r.game == inv || !r.game.IsPlayer(creator.Id) || !r.game.IsPlayer(opponent.Id) {
+			t.Fatalf("case %d: game isn't spawned", i)
+		}
+
+		// Both players are redirected to the game.
+		for _, cl := range []*client{c, creatorClient} {
+			var e event.Event
+			if err := json.Unmarshal(<-cl.send, &e); err != nil {
+				t.Fatal(err)
+			}
+			var url string
+			if err := json.Unmarshal(e.Payload, &url); err != nil {
+				t.Fatal(err)
+			}
+			if e.Kind != event.Redirect || url != tc.expected {
+				t.Fatalf("case %d: expected: %s, got: %s", i, tc.expected, url)
+			}
+		}
+	}
+}
+
+func TestCancelInvitation(t *testing.T) {
+	inv := newInvitation(db.Player{Id: "creator"}, gameRequest{}, stubRepo{}, nil)
+	if inv.Resign("stranger") || !inv.Resign("creator") || inv.Resign("creator") {
+		t.Fatal("only the creator may cancel the invitation once")
+	}
+	if !inv.isExpired {
+		t.Fatal("invitation isn't canceled")
+	}
+}
@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"context"
 	"log"
 	"math/rand/v2"
 	"time"
@@ -30,12 +31,15 @@ type queue struct {
 	unregister chan string
 	ticker     *time.Ticker
 	// Matchmaking parameters.
-	control int // In seconds.
-	bonus   int // In seconds.
+	control db.TimeControl
+	// Casual queues accept guests and spawn games which don't affect ratings.
+	isRated bool
+	// Correspondence queues spawn games with the specified days per move
+	// instead of the time control.  Zero for real time queues.
+	days int
 }
 
-func newQueue(create chan createRoomPayload,
-	control, bonus int,
+func newQueue(create chan createRoomPayload, tc db.TimeControl, isRated bool,
 	gr db.GameRepo, pr db.PlayerRepo,
 ) queue {
 	return queue{
@@ -47,16 +51,25 @@ func newQueue(create chan createRoomPayload,
 		register:   make(chan *client),
 		unregister: make(chan string),
 		clients:    make(map[string]*client),
-		control:    control,
-		bonus:      bonus,
+		control:    tc,
+		isRated:    isRated,
 	}
 }
 
 // listenEvent handles concurrent client registration, unregistration and
-// matchmaking ticks.
-func (q queue) listenEvents() {
+// matchmaking ticks until the context is canceled.  Clients are notified about
+// the maintenance and disconnected on shutdown.
+func (q queue) listenEvents(ctx context.Context) {
+	defer q.ticker.Stop()
+
 	for {
 		select {
+		case <-ctx.Done():
+			for _, c := range q.clients {
+				c.disconnect(event.JSON(event.Error, msgShutdown))
+			}
+			return
+
 		case c := <-q.register:
 			q.add(c)
 			q.broadcast(event.JSON(event.ClientsCounter, len(q.clients)))
@@ -67,7 +80,7 @@ func (q queue) listenEvents() {
 
 		case <-q.ticker.C:
 			for ids := range q.pool.MakeMatches() {
-				q.match(ids)
+				q.match(ctx, ids)
 			}
 			q.pool.ExpandRatingGaps()
 		}
@@ -86,16 +99,29 @@ func (q queue) add(c *client) {
 		return
 	}
 
-	if c.player.IsGuest {
+	if c.player.IsGuest && (q.isRated || q.days != 0) {
 		// Redirect guest players to signup page.
 		c.send <- event.JSON(event.Redirect, "/signup")
 		return
 	}
 
+	// Players are matched by their rating in the category of the time control.
+	c.rating = c.player.Rating
+	deviation := 0.0
+	if !c.player.IsGuest && q.days == 0 {
+		p, err := q.playerRepo.SelectById(c.player.Id, q.control.Category())
+		if err != nil {
+			log.Print(err)
+			c.send <- event.JSON(event.Error, msgRoomCreationFailed)
+			return
+		}
+		c.rating, deviation = p.Rating, p.Deviation
+	}
+
 	c.unregister = q.unregister
 	q.clients[c.player.Id] = c
 	// Join the matchmaking pool.
-	q.pool.Join(c.player.Id, c.player.Rating)
+	q.pool.Join(c.player.Id, c.rating, deviation)
 }
 
 func (q queue) remove(id string) {
@@ -105,10 +131,10 @@ func (q queue) remove(id string) {
 		return
 	}
 	delete(q.clients, id)
-	q.pool.Leave(id, c.player.Rating)
+	q.pool.Leave(id, c.rating)
 }
 
-func (q queue) match(ids [2]string) {
+func (q queue) match(ctx context.Context, ids [2]string) {
 	roomId := randgen.GenId(randgen.IdLen)
 
 	// Randomly select players' sides.
@@ -127,8 +153,13 @@ func (q queue) match(ids [2]string) {
 		return
 	}
 
-	g, err := game.SpawnRatedGame(
-		w.player, b.player, q.control, q.bonus,
+	if q.days != 0 {
+		q.matchCorrespondence(ids, w.player, b.player, roomId)
+		return
+	}
+
+	g, url, err := spawnGame(
+		w.player, b.player, q.control, q.isRated, "",
 		roomId, q.gameRepo, q.playerRepo,
 	)
 	if err != nil {
@@ -140,25 +171,72 @@ func (q queue) match(ids [2]string) {
 			game: g,
 			res:  make(chan struct{}, 1),
 		}
-		q.create <- p
 		// Wait for response to redirect clients only after room is ready.
-		<-p.res
-
+		if !requestRoom(ctx, q.create, p) {
+			g.Abandon()
+			return
+		}
 		// Redirect clients to room.
-		q.sendEvent(ids, event.JSON(event.Redirect, "/rated/"+roomId))
+		q.sendEvent(ids, event.JSON(event.Redirect, url))
+	}
+}
+
+// spawnGame spawns the rated or casual game between the players which starts
+// from the position specified by FEN.  Returns the game along with the url of
+// its page.
+func spawnGame(
+	white, black db.Player, tc db.TimeControl, isRated bool, fen string,
+	id string, gr db.GameRepo, pr db.PlayerRepo,
+) (game.Game, string, error) {
+	if isRated {
+		g, err := game.SpawnRatedGame(white, black, tc, fen, id, gr, pr)
+		return g, "/rated/" + id, err
+	}
+	g, err := game.SpawnCasualGame(white, black, tc, fen, id, gr)
+	return g, "/casual/" + id, err
+}
+
+// requestRoom asks the service to create the room and waits until it's ready.
+// Returns false if the context is canceled meanwhile.
+func requestRoom(ctx context.Context, create chan<- createRoomPayload, p createRoomPayload) bool {
+	select {
+	case create <- p:
+	case <-ctx.Done():
+		return false
+	}
+
+	select {
+	case <-p.res:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// matchCorrespondence spawns the correspondence game.  The room isn't created,
+// since it will be created on demand when players open the game.
+func (q queue) matchCorrespondence(ids [2]string, white, black db.Player, id string) {
+	_, err := game.SpawnCorrespondenceGame(white, black, q.days, id, q.gameRepo)
+	if err != nil {
+		log.Print(err)
+		q.sendEvent(ids, event.JSON(event.Error, msgRoomCreationFailed))
+		return
 	}
+	q.sendEvent(ids, event.JSON(event.Redirect, "/correspondence/"+id))
 }
 
 func (q queue) sendEvent(players [2]string, raw []byte) {
 	for _, id := range players {
 		if c, exists := q.clients[id]; exists {
-			c.send <- raw
+			c.mustSend(raw)
 		}
 	}
 }
 
+// broadcast sends the event which is superseded by the next one, i.e.
+// [event.ClientsCounter].  The event is dropped for slow clients.
 func (q queue) broadcast(raw []byte) {
 	for _, c := range q.clients {
-		c.send <- raw
+		c.drop(raw)
 	}
 }
@@ -0,0 +1,57 @@
+package ws
+
+import "justchess/internal/event"
+
+// Number of the latest events kept by the room for reconnecting clients.
+const replayBufferSize = 128
+
+type replayEntry struct {
+	raw []byte
+	// Id of the recipient or empty string if the event was broadcasted.
+	to  string
+	seq uint64
+}
+
+// replayBuffer numbers outgoing room events and keeps the latest ones, so the
+// reconnecting client can receive the events sent while it was disconnected.
+type replayBuffer struct {
+	entries []replayEntry
+	// Sequence number of the last event.
+	seq uint64
+}
+
+// push numbers the event and stores it.  Returns the encoded event.
+func (b *replayBuffer) push(k event.Kind, p any, to string) []byte {
+	b.seq++
+	raw := event.Numbered(k, p, b.seq)
+
+	if len(b.entries) == replayBufferSize {
+		copy(b.entries, b.entries[1:])
+		b.entries = b.entries[:len(b.entries)-1]
+	}
+	b.entries = append(b.entries, replayEntry{raw: raw, to: to, seq: b.seq})
+	return raw
+}
+
+// missed returns the events sent to the specified client after the event with
+// the specified sequence number.  Returns false if some of the events were
+// discarded from the buffer or the sequence number is unknown.
+func (b *replayBuffer) missed(id string, seq uint64) ([][]byte, bool) {
+	if seq > b.seq {
+		return nil, false
+	}
+	if seq == b.seq {
+		return nil, true
+	}
+	if len(b.entries) == 0 || b.entries[0].seq > seq+1 {
+		return nil, false
+	}
+
+	raws := make([][]byte, 0, b.seq-seq)
+	for _, e := range b.entries {
+		if e.seq > seq && (len(e.to) == 0 || e.to == id) {
+			raws = append(raws, e.raw)
+		}
+	}
+	return raws, true
+}
@@ -0,0 +1,84 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+
+	"justchess/internal/event"
+)
+
+func TestMissed(t *testing.T) {
+	b := &replayBuffer{}
+	b.push(event.Move, nil, "")
+	b.push(event.OfferDraw, nil, "black")
+	b.push(event.Chat, "white: hi", "")
+
+	overflown := &replayBuffer{}
+	for range replayBufferSize + 2 {
+		overflown.push(event.Chat, "", "")
+	}
+
+	cases := []struct {
+		buffer   *replayBuffer
+		id       string
+		seq      uint64
+		expected []uint64
+		ok       bool
+	}{
+		{b, "white", 0, []uint64{1, 3}, true},
+		{b, "black", 0, []uint64{1, 2, 3}, true},
+		{b, "black", 2, []uint64{3}, true},
+		{b, "white", 3, nil, true},
+		// Unknown sequence number, e.g. after the server restart.
+		{b, "white", 4, nil, false},
+		{overflown, "white", 0, nil, false},
+		{overflown, "white", 1, nil, false},
+		{overflown, "white", replayBufferSize + 1, []uint64{replayBufferSize + 2}, true},
+	}
+
+	for i, tc := range cases {
+		raws, ok := tc.buffer.missed(tc.id, tc.seq)
+		if ok != tc.ok {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+
+		got := make([]uint64, 0, len(raws))
+		for _, raw := range raws {
+			var e event.Event
+			if err := json.Unmarshal(raw, &e); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, e.Seq)
+		}
+		if len(got) != len(tc.expected) {
+			t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+		}
+		for j := range got {
+			if got[j] != tc.expected[j] {
+				t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+			}
+		}
+	}
+}
+
+func TestMissedSnapshot(t *testing.T) {
+	r := newRoom("room", stubGame{}, stubRepo{})
+	r.broadcast(event.Move, nil)
+	// E.g. the takeback is accepted.
+	r.broadcastGame()
+
+	raws, ok := r.replay.missed("white", 1)
+	if !ok || len(raws) != 1 {
+		t.Fatalf("expected: 1 event, got: %d", len(raws))
+	}
+	var e event.Event
+	if err := json.Unmarshal(raws[0], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != event.Game || e.Seq != 2 {
+		t.Fatalf("expected: %d %d, got: %d %d", event.Game, 2, e.Kind, e.Seq)
+	}
+}
@@ -1,9 +1,12 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"justchess/internal/db"
 	"justchess/internal/event"
 	"justchess/internal/game"
+	"justchess/internal/randgen"
 	"log"
 	"strings"
 	"time"
@@ -12,44 +15,132 @@ import (
 )
 
 const (
+	msgEngineFailed = "The engine is unavailable. Please, try again later"
+	msgInvalidClaim = "Draw claim is rejected: it isn't your turn, or the position " +
+		"hasn't occurred three times and the fifty-move rule doesn't apply"
+
 	// How many seconds will empty room live.
 	emptyDeadline = 5
+	// How many seconds will empty restored room live.
+	restoredDeadline = 30
+	// The game is checkpointed each 5 seconds to preserve the clock and after
+	// each handled event.
+	checkpointInterval = 5
 )
 
+// liveGame is implemented by games between two players, i.e. rated and casual
+// games.
+type liveGame interface {
+	game.Game
+	OfferDraw(id string) string
+	AcceptDraw(id string) bool
+	DeclineDraw(id string) bool
+	ClaimDraw(id string) bool
+	OfferTakeback(id string) string
+	AcceptTakeback(id string) bool
+	DeclineTakeback(id string) bool
+	Premove(id, uci string) bool
+	CancelPremove(id string) bool
+	PlayPremove() (game.MovePayload, string, bool)
+	OfferRematch(id string) string
+	AcceptRematch(id string) (game.Rematch, bool)
+	DeclineRematch(id string) bool
+}
+
+// checkpointer is implemented by games which can be restored after the server
+// restart.
+type checkpointer interface {
+	Checkpoint() (db.Checkpoint, error)
+}
+
 type room struct {
+	id         string
 	game       game.Game
+	gameRepo   db.GameRepo
+	playerRepo db.PlayerRepo
+	// create is used to request the room of the rematch.
+	create     chan<- createRoomPayload
 	clients    map[string]*client
+	spectators map[string]*client
+	spectate   *spectatorStream
 	register   chan *client
 	unregister chan string
 	handle     chan event.Event
+	// moves receives moves of correspondence games sent over HTTP.
+	moves  chan forwardedMove
+	replay *replayBuffer
+	// engine receives moves found by the engine in engine games.
+	engine     chan game.EngineMove
 	ticker     *time.Ticker
 	timeToLive int
+	ticks      int
+	// checkpoints stores the checkpoints of the game in the background.
+	checkpoints checkpointWriter
+	// Whether the checkpoint of the game is submitted to be stored.
+	isCheckpointed bool
 }
 
-func newRoom(g game.Game) room {
+func newRoom(id string, g game.Game, gr db.GameRepo) room {
 	return room{
+		id:         id,
 		game:       g,
+		gameRepo:   gr,
 		clients:    make(map[string]*client, 2),
+		spectators: make(map[string]*client),
+		spectate:   &spectatorStream{},
 		register:   make(chan *client),
 		unregister: make(chan string),
 		handle:     make(chan event.Event),
+		moves:      make(chan forwardedMove),
+		replay:     &replayBuffer{},
+		engine:     make(chan game.EngineMove, 4),
 		ticker:     time.NewTicker(time.Second),
 		timeToLive: emptyDeadline,
 	}
 }
 
-func (r room) listenEvents(id string, remove chan<- string) {
-	defer func() { remove <- id }()
+// listenEvents handles room events until the room is destroyed or the context
+// is canceled.  On shutdown the game is checkpointed to be restored after the
+// restart instead of being abandoned.
+func (r room) listenEvents(ctx context.Context, remove chan<- string) {
+	defer r.ticker.Stop()
+	defer func() {
+		select {
+		case remove <- r.id:
+		case <-ctx.Done():
+		}
+	}()
+
+	// The engine makes the first move if the player plays black.
+	r.think()
 
 	for {
 		select {
+		case <-ctx.Done():
+			raw := event.JSON(event.Error, msgShutdown)
+			for _, c := range r.clients {
+				c.disconnect(raw)
+			}
+			for _, c := range r.spectators {
+				c.disconnect(raw)
+			}
+			r.checkpoint()
+			return
+
 		case c := <-r.register:
-			r.add(c)
+			if !r.claim(c) {
+				r.add(c)
+			}
 
 		case clientId := <-r.unregister:
 			r.remove(clientId)
 
 		case e := <-r.handle:
+			// Spectators are only allowed to chat.
+			if _, ok := r.spectators[e.SenderId]; ok && e.Kind != event.Chat {
+				continue
+			}
+
 			switch e.Kind {
 			case event.Chat:
 				r.chat(e)
@@ -60,23 +151,18 @@ func (r room) listenEvents(id string, remove chan<- string) {
 					log.Printf("invalid msg from client: %s", err)
 					continue
 				}
-				if p, ok := r.game.Play(e.SenderId, index); ok {
-					r.broadcast(event.JSON(event.Move, p))
-
-					// If game has been terminated, broadcast EndPayload.
-					end := r.game.EndPayload()
-					if end.Termination != chego.Unterminated {
-						r.broadcast(event.JSON(event.End, r.game.EndPayload()))
-					}
-				}
+				r.move(e.SenderId, index)
 
 			case event.Resign:
 				if r.game.Resign(e.SenderId) {
-					r.broadcast(event.JSON(event.End, r.game.EndPayload()))
+					r.broadcast(event.End, r.game.EndPayload())
 				}
 
+			case event.TakebackOffer, event.TakebackAccept, event.TakebackDecline:
+				r.takeback(e)
+
 			default:
-				g, ok := r.game.(*game.RatedGame)
+				g, ok := r.game.(liveGame)
 				if !ok {
 					continue
 				}
@@ -89,76 +175,296 @@ func (r room) listenEvents(id string, remove chan<- string) {
 				switch e.Kind {
 				case event.OfferDraw:
 					if oppId := g.OfferDraw(e.SenderId); len(oppId) != 0 {
-						r.broadcast(event.JSON(event.Chat, sender.player.Name+" offers draw"))
+						r.broadcast(event.Chat, sender.player.Name+" offers draw")
 						if opp := r.clients[oppId]; opp != nil {
-							opp.send <- event.JSON(event.OfferDraw, nil)
+							r.send(opp, event.OfferDraw, nil)
 						}
 					}
 				case event.AcceptDraw:
 					if g.AcceptDraw(e.SenderId) {
-						r.broadcast(event.JSON(event.End, r.game.EndPayload()))
-						r.broadcast(event.JSON(event.Chat, sender.player.Name+" accepts draw"))
+						r.broadcast(event.End, r.game.EndPayload())
+						r.broadcast(event.Chat, sender.player.Name+" accepts draw")
 					}
 				case event.DeclineDraw:
 					if g.DeclineDraw(e.SenderId) {
-						r.broadcast(event.JSON(event.Chat, sender.player.Name+" declines draw"))
+						r.broadcast(event.Chat, sender.player.Name+" declines draw")
+					}
+				case event.Premove:
+					var uci string
+					if err := json.Unmarshal(e.Payload, &uci); err != nil ||
+						!g.Premove(e.SenderId, uci) {
+						r.send(sender, event.CancelPremove, nil)
+					}
+				case event.CancelPremove:
+					g.CancelPremove(e.SenderId)
+				case event.RematchOffer:
+					if oppId := g.OfferRematch(e.SenderId); len(oppId) != 0 {
+						r.broadcast(event.Chat, sender.player.Name+" offers rematch")
+						if opp := r.clients[oppId]; opp != nil {
+							r.send(opp, event.RematchOffer, nil)
+						}
+					}
+				case event.RematchAccept:
+					if m, ok := g.AcceptRematch(e.SenderId); ok {
+						r.rematch(ctx, m)
+					}
+				case event.RematchDecline:
+					if g.DeclineRematch(e.SenderId) {
+						r.broadcast(event.RematchDecline, nil)
+						r.broadcast(event.Chat, sender.player.Name+" declines rematch")
+					}
+				case event.ClaimDraw:
+					if g.ClaimDraw(e.SenderId) {
+						r.broadcast(event.End, r.game.EndPayload())
+						r.broadcast(event.Chat, sender.player.Name+" claims draw")
+					} else {
+						r.send(sender, event.Error, msgInvalidClaim)
 					}
 				}
 			}
 
+			if e.Kind != event.Chat {
+				r.checkpoint()
+			}
+
+		case m := <-r.moves:
+			m.res <- r.move(m.playerId, m.index)
+			r.checkpoint()
+
+		case m := <-r.engine:
+			r.playEngine(m)
+			r.checkpoint()
+
 		case <-r.ticker.C:
 			r.timeTick()
 			if r.timeToLive == 0 {
 				// Destroy the empty room.
 				r.game.Abandon()
+				r.checkpoint()
 				return
 			}
+			if r.ticks%checkpointInterval == 0 {
+				r.checkpoint()
+			}
 		}
 	}
 }
 
-// add adds client to the room.
+// add adds client to the room.  Clients which aren't players of the game join
+// as spectators.
 //
 // Client will not be added if one of the following is true:
 //   - The number of clients has reached the [clientsThreshold];
 //   - The client with the same ID is already connected to the room.
 func (r room) add(c *client) {
-	if len(r.clients) == clientsThreshold {
+	if len(r.clients)+len(r.spectators) == clientsThreshold {
 		c.send <- event.JSON(event.Error, msgTooMany)
 		return
 	}
-	if _, connected := r.clients[c.player.Id]; connected {
+	_, isPlayer := r.clients[c.player.Id]
+	_, isSpectator := r.spectators[c.player.Id]
+	if isPlayer || isSpectator {
 		c.send <- event.JSON(event.Error, msgConflict)
 		return
 	}
 
+	if !r.game.IsPlayer(c.player.Id) {
+		r.addSpectator(c)
+		return
+	}
+
 	r.clients[c.player.Id] = c
 	r.game.Join(c.player.Id)
 
 	c.forward = r.handle
 	c.unregister = r.unregister
 
-	// Send current game state to clients.
-	c.send <- event.JSON(event.Game, r.game.GamePayload())
+	// Send the events missed by the reconnecting client or the current game
+	// state if some of them were discarded.
+	if raws, ok := r.replay.missed(c.player.Id, c.lastSeq); c.isResuming && ok {
+		for _, raw := range raws {
+			c.resync(raw)
+		}
+	} else {
+		c.send <- r.snapshot()
+	}
 
 	// Broadcast number of online players.
-	r.broadcast(event.JSON(event.ClientsCounter, len(r.clients)))
+	r.broadcastCounter()
 }
 
 func (r room) remove(clientId string) {
+	if _, ok := r.spectators[clientId]; ok {
+		delete(r.spectators, clientId)
+		r.broadcastCounter()
+		return
+	}
+
 	if _, connected := r.clients[clientId]; connected {
 		delete(r.clients, clientId)
 		r.game.Leave(clientId)
 
 		// Broadcast number of online players.
-		r.broadcast(event.JSON(event.ClientsCounter, len(r.clients)))
+		r.broadcastCounter()
 	} else {
 		log.Printf("client %s isn't connected", clientId)
 	}
 }
 
+// move performs the player's move and broadcasts it.  Returns false if the move
+// was rejected.
+func (r room) move(playerId string, index byte) bool {
+	// Moves of correspondence games may be sent over HTTP, thus the sender
+	// might not be connected to the room.
+	latency := 0
+	if sender := r.clients[playerId]; sender != nil {
+		latency = int(sender.ping.Load())
+	}
+
+	isOver := r.game.EndPayload().Termination != chego.Unterminated
+	p, ok := r.game.Play(playerId, index, latency)
+	if ok {
+		r.broadcast(event.Move, p)
+		r.premove()
+		r.think()
+	}
+
+	// If game has been terminated, broadcast EndPayload.  The move may also be
+	// rejected due to the sender's time forfeit.
+	end := r.game.EndPayload()
+	if !isOver && end.Termination != chego.Unterminated {
+		r.broadcast(event.End, end)
+	}
+	return ok
+}
+
+// forwardedMove is the move of the correspondence game sent over HTTP.  The
+// room replies whether the move was accepted.
+type forwardedMove struct {
+	res      chan bool
+	playerId string
+	index    byte
+}
+
+// premove performs the premove of the player whose turn has just started.  The
+// player is notified if the premove was illegal.
+func (r room) premove() {
+	g, ok := r.game.(liveGame)
+	if !ok {
+		return
+	}
+
+	p, id, ok := g.PlayPremove()
+	if ok {
+		r.broadcast(event.Move, p)
+		return
+	}
+	if c := r.clients[id]; c != nil {
+		r.send(c, event.CancelPremove, nil)
+	}
+}
+
+// rematch spawns the game of the same kind from the same position and redirects
+// both players to its room.
+func (r room) rematch(ctx context.Context, m game.Rematch) {
+	_, isRated := r.game.(*game.RatedGame)
+	id := randgen.GenId(randgen.IdLen)
+	g, url, err := spawnGame(
+		m.White, m.Black, m.Control, isRated, m.FEN, id, r.gameRepo, r.playerRepo,
+	)
+	if err != nil {
+		log.Print(err)
+		r.broadcast(event.Error, msgRoomCreationFailed)
+		return
+	}
+
+	if !requestRoom(ctx, r.create, createRoomPayload{
+		id:   id,
+		game: g,
+		res:  make(chan struct{}, 1),
+	}) {
+		g.Abandon()
+		return
+	}
+	for _, c := range r.clients {
+		c.mustSend(event.JSON(event.Redirect, url))
+	}
+}
+
+// think starts the engine search if the room hosts an engine game.
+func (r room) think() {
+	if g, ok := r.game.(*game.EngineGame); ok {
+		g.Think(r.engine)
+	}
+}
+
+// playEngine performs the move found by the engine.  The game is abandoned if
+// the engine has failed.
+func (r room) playEngine(m game.EngineMove) {
+	g, ok := r.game.(*game.EngineGame)
+	if !ok {
+		return
+	}
+
+	if m.Err != nil {
+		log.Print(m.Err)
+		g.Abandon()
+		r.broadcast(event.Error, msgEngineFailed)
+		r.broadcast(event.End, g.EndPayload())
+		return
+	}
+
+	if p, ok := g.PlayEngine(m); ok {
+		r.broadcast(event.Move, p)
+		if end := g.EndPayload(); end.Termination != chego.Unterminated {
+			r.broadcast(event.End, end)
+		}
+	}
+}
+
+// takeback handles takeback events.  Engine games accept takeback offers
+// immediately.
+func (r room) takeback(e event.Event) {
+	sender := r.clients[e.SenderId]
+	if sender == nil {
+		return
+	}
+
+	switch g := r.game.(type) {
+	case *game.EngineGame:
+		if e.Kind == event.TakebackOffer && g.Takeback(e.SenderId) {
+			r.broadcastGame()
+		}
+
+	case liveGame:
+		switch e.Kind {
+		case event.TakebackOffer:
+			if oppId := g.OfferTakeback(e.SenderId); len(oppId) != 0 {
+				r.broadcast(event.Chat, sender.player.Name+" offers takeback")
+				if opp := r.clients[oppId]; opp != nil {
+					r.send(opp, event.TakebackOffer, nil)
+				}
+			}
+		case event.TakebackAccept:
+			if g.AcceptTakeback(e.SenderId) {
+				r.broadcastGame()
+				r.broadcast(event.Chat, sender.player.Name+" accepts takeback")
+			}
+		case event.TakebackDecline:
+			if g.DeclineTakeback(e.SenderId) {
+				r.broadcast(event.Chat, sender.player.Name+" declines takeback")
+			}
+		}
+	}
+}
+
+// chat broadcasts the message.  Spectators' messages aren't delayed.
 func (r room) chat(e event.Event) {
-	name := r.clients[e.SenderId].player.Name
+	sender, isPlayer := r.clients[e.SenderId]
+	if !isPlayer {
+		sender = r.spectators[e.SenderId]
+	}
+	name := sender.player.Name
 
 	var b strings.Builder
 	// Append sender's name.
@@ -167,25 +473,113 @@ func (r room) chat(e event.Event) {
 	// Append message.
 	b.WriteString(strings.TrimSpace(strings.ReplaceAll(string(e.Payload), "\"", " ")))
 
-	e.Payload = json.RawMessage(b.String())
-	r.broadcast(event.JSON(event.Chat, b.String()))
+	switch {
+	case !isPlayer:
+		r.spectatorChat(b.String())
+	case r.spectate.config.IsChatSeparated:
+		raw := r.replay.push(event.Chat, b.String(), "")
+		for _, c := range r.clients {
+			c.deliver(event.Chat, raw)
+		}
+	default:
+		r.broadcast(event.Chat, b.String())
+	}
 }
 
 func (r *room) timeTick() {
-	if len(r.clients) == 0 {
+	r.ticks++
+	r.flushSpectators()
+	r.resyncStale()
+	if len(r.clients)+len(r.spectators) == 0 {
 		r.timeToLive--
 	}
 
 	if p := r.game.EndPayload(); p.Termination == chego.Unterminated {
 		r.game.TimeTick()
 		if p = r.game.EndPayload(); p.Termination != chego.Unterminated {
-			r.broadcast(event.JSON(event.End, p))
+			r.broadcast(event.End, p)
+		}
+	}
+}
+
+// checkpoint submits the state of the unterminated game to be stored, so it
+// can be restored after the server restart.  The checkpoint of the terminated
+// game is deleted.
+func (r *room) checkpoint() {
+	g, ok := r.game.(checkpointer)
+	if !ok {
+		return
+	}
+
+	if r.game.EndPayload().Termination != chego.Unterminated {
+		if r.isCheckpointed {
+			r.checkpoints.submit(r.id, checkpointTask{isDeleted: true})
+			r.isCheckpointed = false
+		}
+		return
+	}
+
+	c, err := g.Checkpoint()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	r.checkpoints.submit(r.id, checkpointTask{checkpoint: c})
+	r.isCheckpointed = true
+}
+
+// broadcast numbers the event and sends it to every player without blocking
+// and to spectators after the delay.  Slow clients will receive the game
+// snapshot instead of the missed moves.
+func (r room) broadcast(k event.Kind, p any) {
+	raw := r.replay.push(k, p, "")
+	for _, c := range r.clients {
+		c.deliver(k, raw)
+	}
+	r.pushSpectators(k, raw)
+}
+
+// send numbers the event and sends it to the specified client.
+func (r room) send(c *client, k event.Kind, p any) {
+	c.deliver(k, r.replay.push(k, p, c.player.Id))
+}
+
+// snapshot returns the game state numbered with the sequence number of the
+// last sent event.
+func (r room) snapshot() []byte {
+	return event.Numbered(event.Game, r.game.GamePayload(), r.replay.seq)
+}
+
+// broadcastCounter sends the number of connected players and spectators.  The
+// events are dropped for slow clients, since they are superseded by the next
+// ones.
+func (r room) broadcastCounter() {
+	players := event.JSON(event.ClientsCounter, len(r.clients))
+	spectators := event.JSON(event.SpectatorsCounter, len(r.spectators))
+	for _, clients := range [...]map[string]*client{r.clients, r.spectators} {
+		for _, c := range clients {
+			c.drop(players)
+			c.drop(spectators)
 		}
 	}
 }
 
-func (r room) broadcast(raw []byte) {
+// resyncStale sends the game snapshot to the stale clients.
+func (r room) resyncStale() {
+	var raw []byte
 	for _, c := range r.clients {
-		c.send <- raw
+		if !c.isStale {
+			continue
+		}
+		if raw == nil {
+			raw = r.snapshot()
+		}
+		c.snapshot(raw)
+	}
+
+	for _, c := range r.spectators {
+		if c.isStale {
+			c.snapshot(r.spectatorSnapshot())
+		}
 	}
 }
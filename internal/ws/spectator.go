@@ -0,0 +1,112 @@
+package ws
+
+import (
+	"time"
+
+	"justchess/internal/event"
+)
+
+// SpectatorConfig describes how spectators are served.
+type SpectatorConfig struct {
+	// Delay of the spectator event stream.  Prevents players from receiving
+	// help from spectators during the game.
+	Delay time.Duration
+	// Whether the spectator chat is hidden from players and vice versa.
+	IsChatSeparated bool
+}
+
+type delayedEvent struct {
+	at   time.Time
+	raw  []byte
+	kind event.Kind
+	// Game state after the event.
+	snapshot []byte
+}
+
+// spectatorStream delays the room events sent to spectators.
+type spectatorStream struct {
+	pending []delayedEvent
+	// Game state which is up to date with the delivered events.  Sent to the
+	// joining spectators.  Stays at the state the room was created with until
+	// the first delayed event is delivered.
+	snapshot []byte
+	config   SpectatorConfig
+}
+
+// configureSpectators sets the spectator config.  Must be called before the
+// room starts handling events, since the current game state is the one
+// spectators see until the first delayed event is delivered.
+func (r room) configureSpectators(c SpectatorConfig) {
+	r.spectate.config = c
+	r.spectate.snapshot = r.snapshot()
+}
+
+// push schedules the event for delivery to the spectators.  Events are
+// delivered immediately if there is no delay.
+func (r room) pushSpectators(k event.Kind, raw []byte) {
+	s := r.spectate
+	if s.config.Delay == 0 {
+		r.sendSpectators(k, raw)
+		return
+	}
+	s.pending = append(s.pending, delayedEvent{
+		at:       time.Now().Add(s.config.Delay),
+		raw:      raw,
+		kind:     k,
+		snapshot: r.snapshot(),
+	})
+}
+
+// flushSpectators delivers the delayed events which are due.
+func (r room) flushSpectators() {
+	s := r.spectate
+	n := 0
+	for ; n < len(s.pending) && !time.Now().Before(s.pending[n].at); n++ {
+		r.sendSpectators(s.pending[n].kind, s.pending[n].raw)
+		s.snapshot = s.pending[n].snapshot
+	}
+	s.pending = s.pending[n:]
+}
+
+// spectatorSnapshot returns the game state which is up to date with the events
+// delivered to spectators.  The live state is never sent while the delay is
+// set, even if none of the delayed events have been delivered yet.
+func (r room) spectatorSnapshot() []byte {
+	if r.spectate.config.Delay == 0 {
+		return r.snapshot()
+	}
+	return r.spectate.snapshot
+}
+
+func (r room) sendSpectators(k event.Kind, raw []byte) {
+	for _, c := range r.spectators {
+		c.deliver(k, raw)
+	}
+}
+
+// addSpectator adds the client as a spectator.  Spectators always receive the
+// snapshot, since replayed events would bypass the delay.
+func (r room) addSpectator(c *client) {
+	r.spectators[c.player.Id] = c
+
+	c.forward = r.handle
+	c.unregister = r.unregister
+	c.send <- r.spectatorSnapshot()
+
+	r.broadcastCounter()
+}
+
+// spectatorChat sends the spectator's message without delay.  Players receive
+// it only if the chats aren't separated.
+func (r room) spectatorChat(msg string) {
+	if r.spectate.config.IsChatSeparated {
+		r.sendSpectators(event.Chat, event.JSON(event.Chat, msg))
+		return
+	}
+
+	raw := r.replay.push(event.Chat, msg, "")
+	for _, c := range r.clients {
+		c.deliver(event.Chat, raw)
+	}
+	r.sendSpectators(event.Chat, raw)
+}
@@ -0,0 +1,134 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+	"justchess/internal/event"
+	"justchess/internal/game"
+
+	"github.com/treepeck/chego"
+)
+
+// kinds returns the kinds of the events sent to the client.
+func kinds(t *testing.T, c *client) []event.Kind {
+	res := make([]event.Kind, 0, len(c.send))
+	for len(c.send) > 0 {
+		var e event.Event
+		if err := json.Unmarshal(<-c.send, &e); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, e.Kind)
+	}
+	return res
+}
+
+func TestSpectatorDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	r := newRoom("room", stubGame{}, stubRepo{})
+	r.configureSpectators(SpectatorConfig{Delay: delay})
+
+	player := &client{player: db.Player{Id: "player"}, send: make(chan []byte, 16)}
+	spectator := &client{player: db.Player{Id: "spectator"}, send: make(chan []byte, 16)}
+	r.add(player)
+	r.add(spectator)
+	kinds(t, player)
+	kinds(t, spectator)
+
+	if len(r.clients) != 1 || len(r.spectators) != 1 {
+		t.Fatalf("expected 1 player and 1 spectator, got: %d and %d",
+			len(r.clients), len(r.spectators))
+	}
+
+	r.broadcast(event.Move, nil)
+	r.flushSpectators()
+	if got := kinds(t, spectator); len(got) != 0 {
+		t.Fatalf("spectator received events before the delay: %v", got)
+	}
+	if got := kinds(t, player); len(got) != 1 || got[0] != event.Move {
+		t.Fatalf("expected: %v, got: %v", []event.Kind{event.Move}, got)
+	}
+
+	time.Sleep(delay)
+	r.flushSpectators()
+	if got := kinds(t, spectator); len(got) != 1 || got[0] != event.Move {
+		t.Fatalf("expected: %v, got: %v", []event.Kind{event.Move}, got)
+	}
+}
+
+func TestSeparatedChat(t *testing.T) {
+	cases := []struct {
+		isChatSeparated bool
+		sender          string
+		// Expected number of chat messages received by the player and the
+		// spectator.
+		player    int
+		spectator int
+	}{
+		{false, "player", 1, 1},
+		{false, "spectator", 1, 1},
+		{true, "player", 1, 0},
+		{true, "spectator", 0, 1},
+	}
+
+	for i, tc := range cases {
+		r := newRoom("room", stubGame{}, stubRepo{})
+		r.configureSpectators(SpectatorConfig{IsChatSeparated: tc.isChatSeparated})
+
+		player := &client{player: db.Player{Id: "player"}, send: make(chan []byte, 16)}
+		spectator := &client{player: db.Player{Id: "spectator"}, send: make(chan []byte, 16)}
+		r.add(player)
+		r.add(spectator)
+		kinds(t, player)
+		kinds(t, spectator)
+
+		r.chat(event.Event{Kind: event.Chat, Payload: []byte(`"hi"`), SenderId: tc.sender})
+
+		if got := len(kinds(t, player)); got != tc.player {
+			t.Fatalf("case %d: player: expected: %d, got: %d", i, tc.player, got)
+		}
+		if got := len(kinds(t, spectator)); got != tc.spectator {
+			t.Fatalf("case %d: spectator: expected: %d, got: %d", i, tc.spectator, got)
+		}
+	}
+}
+
+// playedGame is the stub game whose state consists of the played moves.
+type playedGame struct {
+	stubGame
+	played *[]chego.PlayedMove
+}
+
+func (g playedGame) GamePayload() game.GamePayload {
+	return game.GamePayload{Played: *g.played}
+}
+
+func TestDelayedSnapshot(t *testing.T) {
+	played := make([]chego.PlayedMove, 0)
+	r := newRoom("room", playedGame{played: &played}, stubRepo{})
+	r.configureSpectators(SpectatorConfig{Delay: time.Minute})
+
+	played = append(played, chego.PlayedMove{San: "e4"})
+	r.broadcast(event.Move, nil)
+	r.flushSpectators()
+
+	// The spectator joins before the move is delivered, thus it must receive
+	// the state the room was created with.
+	spectator := &client{player: db.Player{Id: "spectator"}, send: make(chan []byte, 16)}
+	r.add(spectator)
+
+	var e event.Event
+	if err := json.Unmarshal(<-spectator.send, &e); err != nil {
+		t.Fatal(err)
+	}
+	var p game.GamePayload
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != event.Game || len(p.Played) != 0 {
+		t.Fatalf("expected: %d moves, got: %d", 0, len(p.Played))
+	}
+}
@@ -2,14 +2,21 @@
 package ws
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"justchess/internal/auth"
 	"justchess/internal/db"
 	"justchess/internal/game"
+	"justchess/internal/position"
 	"justchess/internal/randgen"
 
 	"github.com/gorilla/websocket"
@@ -21,11 +28,39 @@ const (
 	msgTooMany    = "There are too many active players. Please, try again later"
 	msgConflict   = "Please close any previous tabs and reload the page to reconnect"
 	msgBadRequest = "Malformed request body"
+	msgRejected   = "The move is rejected"
+	msgBusy       = "The game is busy. Please, try again later"
+	msgShutdown   = "The server is restarting for maintenance. Please, try again " +
+		"in a minute"
 
 	// Max number of clients per room or queue.
 	clientsThreshold = 1000
+
+	// Interval at which expired correspondence games are adjudicated.
+	adjudicationTick = time.Minute
+	// Time to wait for the room to accept the forwarded move.
+	forwardWait = time.Second
+	// Games with older checkpoints are abandoned instead of being restored,
+	// since players cannot be expected to wait for that long.
+	maxCheckpointAge = 2 * time.Minute
 )
 
+// Time controls of the matchmaking queues.  Rated queue id is the index of its
+// time control.
+var controls = [...]db.TimeControl{
+	{Control: 60}, {Control: 120, Bonus: 1}, {Control: 180}, {Control: 180, Bonus: 2},
+	{Control: 300}, {Control: 300, Bonus: 2}, {Control: 600}, {Control: 600, Bonus: 10},
+	{Control: 900, Bonus: 10},
+	{Control: 300, Bonus: 3, Type: db.Delay},
+	{Control: 600, Bonus: 5, Type: db.Bronstein},
+	// 40/90+30.
+	{Control: 5400, Bonus: 30, Stages: db.Stages{{Move: 40, Time: 1800}}},
+}
+
+// Days per move of the correspondence queues.  Correspondence queue id is the
+// number of days prefixed with "d".
+var correspondenceDays = [...]int{1, 3, 7, 14}
+
 // upgrader is used to establish a WebSocket connection.
 // It is safe for concurrent use.
 var upgrader = websocket.Upgrader{
@@ -47,25 +82,39 @@ type createRoomPayload struct {
 	id   string
 	game game.Game
 	res  chan struct{}
+	// Restored rooms wait longer for players to reconnect.
+	isRestored bool
 }
 
 // Service manages the [room] lifecycle (creation and deletion) and handles
 // incomming handshake requests.
 type Service struct {
+	// closed is closed when the service stops handling events.
+	closed chan struct{}
+	// Tracks the room and queue goroutines to wait for them on shutdown.
+	wg          *sync.WaitGroup
+	spectators  SpectatorConfig
 	gameRepo    db.GameRepo
 	playerRepo  db.PlayerRepo
+	engine      game.Engine
+	checkpoints checkpointWriter
 	rooms       map[string]room
 	queues      map[string]queue
+	challenges  challengeHub
 	searchRoom  chan searchRoomPayload
 	searchQueue chan searchQueuePayload
 	create      chan createRoomPayload
 	remove      chan string
 }
 
-func NewService(gr db.GameRepo, pr db.PlayerRepo) Service {
+func NewService(gr db.GameRepo, pr db.PlayerRepo, e game.Engine) Service {
 	s := Service{
+		closed:      make(chan struct{}),
+		wg:          new(sync.WaitGroup),
 		gameRepo:    gr,
 		playerRepo:  pr,
+		engine:      e,
+		checkpoints: newCheckpointWriter(gr),
 		rooms:       make(map[string]room),
 		queues:      make(map[string]queue),
 		searchRoom:  make(chan searchRoomPayload, 10),
@@ -74,26 +123,118 @@ func NewService(gr db.GameRepo, pr db.PlayerRepo) Service {
 		remove:      make(chan string, 10),
 	}
 
-	controls := [9]struct{ control, bonus int }{{60, 0}, {120, 1}, {180, 0}, {180, 2}, {300, 0}, {300, 2}, {600, 0}, {600, 10}, {900, 10}}
-	var i byte
-	for i = range 9 {
-		q := newQueue(s.create, controls[i].control, controls[i].bonus, gr, pr)
-		go q.listenEvents()
-		s.queues[string(i+'0')] = q
+	for i, tc := range controls {
+		s.queues[strconv.Itoa(i)] = newQueue(s.create, tc, true, gr, pr)
+		// Casual queues are prefixed with "c".
+		s.queues["c"+strconv.Itoa(i)] = newQueue(s.create, tc, false, gr, pr)
 	}
+
+	for _, d := range correspondenceDays {
+		q := newQueue(s.create, db.TimeControl{}, false, gr, pr)
+		q.days = d
+		s.queues["d"+strconv.Itoa(d)] = q
+	}
+
+	s.challenges = newChallengeHub(s.create, gr, pr)
+	return s
+}
+
+// WithSpectators returns the service which serves spectators according to the
+// config.  Must be called before [Service.ListenEvents].
+func (s Service) WithSpectators(c SpectatorConfig) Service {
+	s.spectators = c
 	return s
 }
 
 func (s Service) RegisterRoutes(authService auth.Service, mux *http.ServeMux) {
 	mux.HandleFunc("GET /ws/{id}", authService.MustAuthorize(s.handshake))
+	mux.HandleFunc("GET /ws/challenges", authService.MustAuthorize(s.challengeHandshake))
+	mux.HandleFunc("POST /challenge", authService.MustAuthorize(s.issueChallenge))
+	mux.HandleFunc("POST /invite", authService.MustAuthorize(s.createInvitation))
 	mux.HandleFunc("POST /play-vs-engine", authService.MustAuthorize(s.createEngineRoom))
+	mux.HandleFunc("POST /correspondence/{id}/move",
+		authService.MustAuthorize(s.correspondenceMove))
 }
 
-func (s Service) ListenEvents() {
+// restoreRooms creates rooms for the games checkpointed before the server
+// restart.  Games with outdated checkpoints are abandoned regardless of their
+// kind, since players cannot be blamed for the interruption.  Checkpoints of
+// the games terminated before the restart are deleted, since they might be left
+// if the server stops before the writer deletes them.
+func (s Service) restoreRooms(ctx context.Context) {
+	checkpoints, err := s.gameRepo.SelectCheckpoints()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, c := range checkpoints {
+		t, err := s.gameRepo.SelectTermination(c)
+		if err != nil {
+			log.Printf("cannot select game %s: %s", c.Id, err)
+			continue
+		}
+		if t != chego.Unterminated {
+			log.Printf("game %s is already terminated", c.Id)
+			if err = s.gameRepo.DeleteCheckpoint(c.Id); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+
+		g, err := game.Restore(c, s.gameRepo, s.engine)
+		if err != nil {
+			log.Printf("cannot restore game %s: %s", c.Id, err)
+			continue
+		}
+
+		if time.Since(c.UpdatedAt) > maxCheckpointAge {
+			log.Printf("checkpoint of game %s is outdated", c.Id)
+			g.Abandon()
+			if err = s.gameRepo.DeleteCheckpoint(c.Id); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+
+		s.createRoom(ctx, createRoomPayload{
+			id:         c.Id,
+			game:       g,
+			res:        make(chan struct{}, 1),
+			isRestored: true,
+		})
+	}
+}
+
+// ListenEvents starts the queues and the challenge hub, restores the
+// checkpointed rooms and handles events until the context is canceled.  Then it
+// stops accepting handshakes, notifies clients about the maintenance and waits
+// until rooms checkpoint their games and exit and the checkpoints are stored.
+func (s Service) ListenEvents(ctx context.Context) {
+	stopWriter, writerStopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		s.checkpoints.listenEvents(stopWriter)
+		close(writerStopped)
+	}()
+
+	for _, q := range s.queues {
+		s.wg.Go(func() { q.listenEvents(ctx) })
+	}
+	s.wg.Go(func() { s.challenges.listenEvents(ctx) })
+	s.restoreRooms(ctx)
+
 	for {
 		select {
+		case <-ctx.Done():
+			close(s.closed)
+			s.wg.Wait()
+			close(stopWriter)
+			<-writerStopped
+			log.Print("all rooms and queues are stopped")
+			return
+
 		case e := <-s.create:
-			s.createRoom(e)
+			s.createRoom(ctx, e)
 
 		case id := <-s.remove:
 			s.handleRemoveRoom(id)
@@ -125,7 +266,12 @@ func (s Service) ListenEvents() {
 //   - No room or queue exists with the provided id;
 //   - The client is already registered in the room or queue.
 //
-// The connection will be closed after the error event is sent.
+// The connection will be closed after the error event is sent.  Handshakes are
+// refused once the service is closed.
+//
+// Clients reconnecting to the room may specify the sequence number of the last
+// received event in the 'seq' query parameter to receive the missed events
+// instead of the game snapshot.
 func (s Service) handshake(rw http.ResponseWriter, r *http.Request) {
 	p, ok := r.Context().Value(auth.PlayerKey).(db.Player)
 	if !ok {
@@ -133,15 +279,25 @@ func (s Service) handshake(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.isClosed() {
+		http.Error(rw, msgShutdown, http.StatusServiceUnavailable)
+		return
+	}
+
 	id := r.PathValue("id")
-	// Search for a room with the given id.
-	pr := searchRoomPayload{
-		id:  id,
-		res: make(chan *room),
+	// Search for a room or a queue with the given id.  Rooms of correspondence
+	// games are created on demand.
+	room := s.findRoom(id)
+	var q *queue
+	if room == nil {
+		q = s.findQueue(id)
+	}
+	if room == nil && q == nil {
+		ctx, cancel := s.withClosed(r.Context())
+		defer cancel()
+		room = s.loadCorrespondenceRoom(ctx, id)
 	}
-	s.searchRoom <- pr
-	// Handle response.
-	if room := <-pr.res; room != nil {
+	if room != nil {
 		// Create WebSocket connection.
 		conn, err := upgrader.Upgrade(rw, r, nil)
 		if err != nil {
@@ -149,20 +305,18 @@ func (s Service) handshake(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 		c := newClient(conn, p)
+		// Reconnecting clients specify the last received sequence number to
+		// receive the missed events.
+		if seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64); err == nil {
+			c.lastSeq, c.isResuming = seq, true
+		}
 		go c.read()
 		go c.write()
 		room.register <- c
 		return
 	}
 
-	// Search for a queue with the given id.
-	pq := searchQueuePayload{
-		id:  id,
-		res: make(chan *queue),
-	}
-	s.searchQueue <- pq
-	// Handle response.
-	if q := <-pq.res; q != nil {
+	if q != nil {
 		// Create WebSocket connection.
 		conn, err := upgrader.Upgrade(rw, r, nil)
 		if err != nil {
@@ -179,6 +333,27 @@ func (s Service) handshake(rw http.ResponseWriter, r *http.Request) {
 	http.Error(rw, msgNotFound, http.StatusNotFound)
 }
 
+// engineRequest is the request body of the game vs engine.
+type engineRequest struct {
+	Difficulty db.EngineDifficulty `json:"d"`
+	// FEN of the starting position.  Empty for the standard one.
+	FEN string `json:"f,omitempty"`
+}
+
+// UnmarshalJSON decodes the request.  The bare difficulty sent by the clients
+// which don't support custom positions is accepted as well.
+func (req *engineRequest) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &req.Difficulty); err == nil {
+		return nil
+	}
+	// Prevents the infinite recursion.
+	type request engineRequest
+	return json.Unmarshal(data, (*request)(req))
+}
+
+// createEngineRoom handles requests to play vs engine.  The request will be
+// denied if engine games are disabled, the body is malformed, the difficulty
+// doesn't exist or the starting position is invalid.
 func (s Service) createEngineRoom(rw http.ResponseWriter, r *http.Request) {
 	p, ok := r.Context().Value(auth.PlayerKey).(db.Player)
 	if !ok {
@@ -186,9 +361,15 @@ func (s Service) createEngineRoom(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var d db.EngineDifficulty
-	if err := json.NewDecoder(r.Body).Decode(&d); err != nil ||
-		d < db.Easy || d > db.Impossible {
+	if s.engine == nil {
+		http.Error(rw, msgEngineFailed, http.StatusServiceUnavailable)
+		return
+	}
+
+	var req engineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		req.Difficulty < db.Easy || req.Difficulty > db.Impossible ||
+		(len(req.FEN) != 0 && position.Validate(req.FEN) != nil) {
 		http.Error(rw, msgBadRequest, http.StatusBadRequest)
 		return
 	}
@@ -199,27 +380,218 @@ func (s Service) createEngineRoom(rw http.ResponseWriter, r *http.Request) {
 		c = chego.ColorBlack
 	}
 
-	g, err := game.SpawnEngineGame(id, p.Id, c, d, s.gameRepo)
+	g, err := game.SpawnEngineGame(
+		id, p.Id, c, req.Difficulty, req.FEN, s.gameRepo, s.engine,
+	)
 	if err != nil {
 		http.Error(rw, msgRoomCreationFailed, http.StatusInternalServerError)
 		return
 	}
-	e := createRoomPayload{
+	ctx, cancel := s.withClosed(r.Context())
+	defer cancel()
+	// Wait for response to redirect clients only after room is ready.
+	if !requestRoom(ctx, s.create, createRoomPayload{
 		id:   id,
 		game: g,
 		res:  make(chan struct{}, 1),
+	}) {
+		g.Abandon()
+		http.Error(rw, msgShutdown, http.StatusServiceUnavailable)
+		return
 	}
-	s.create <- e
-	// Wait for response to redirect clients only after room is ready.
-	<-e.res
 
 	http.Redirect(rw, r, "/engine/"+id, http.StatusFound)
 }
 
-func (s Service) createRoom(p createRoomPayload) {
+// findRoom returns the room with the specified id or nil if it doesn't exist
+// or the service is closed.
+func (s Service) findRoom(id string) *room {
+	p := searchRoomPayload{
+		id:  id,
+		res: make(chan *room),
+	}
+	select {
+	case s.searchRoom <- p:
+	case <-s.closed:
+		return nil
+	}
+
+	select {
+	case res := <-p.res:
+		return res
+	case <-s.closed:
+		return nil
+	}
+}
+
+// findQueue returns the queue with the specified id or nil if it doesn't exist
+// or the service is closed.
+func (s Service) findQueue(id string) *queue {
+	p := searchQueuePayload{
+		id:  id,
+		res: make(chan *queue),
+	}
+	select {
+	case s.searchQueue <- p:
+	case <-s.closed:
+		return nil
+	}
+
+	select {
+	case res := <-p.res:
+		return res
+	case <-s.closed:
+		return nil
+	}
+}
+
+// withClosed returns the copy of the parent context which is also canceled
+// once the service is closed.  Used by requests which wait for the service.
+func (s Service) withClosed(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s Service) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// loadCorrespondenceRoom loads the correspondence game with the specified id
+// and creates its room.  Returns nil if the game doesn't exist or the context is
+// canceled.
+func (s Service) loadCorrespondenceRoom(ctx context.Context, id string) *room {
+	// Skip the database query for ids which cannot belong to a game.
+	if !randgen.IsId(id, randgen.IdLen) {
+		return nil
+	}
+	g, err := game.LoadCorrespondenceGame(id, s.gameRepo)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Print(err)
+		}
+		return nil
+	}
+
+	p := createRoomPayload{
+		id:   id,
+		game: g,
+		res:  make(chan struct{}, 1),
+	}
+	if !requestRoom(ctx, s.create, p) {
+		return nil
+	}
+	return s.findRoom(id)
+}
+
+// correspondenceMove handles moves sent over HTTP.  The move is always
+// performed by the room of the game, which is created if the game isn't open,
+// so the game has a single owner.
+func (s Service) correspondenceMove(rw http.ResponseWriter, r *http.Request) {
+	p, ok := r.Context().Value(auth.PlayerKey).(db.Player)
+	if !ok {
+		log.Print("request context is broken")
+		return
+	}
+
+	var index byte
+	if err := json.NewDecoder(r.Body).Decode(&index); err != nil {
+		http.Error(rw, msgBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.withClosed(r.Context())
+	defer cancel()
+	id := r.PathValue("id")
+	room := s.findRoom(id)
+	if room == nil {
+		room = s.loadCorrespondenceRoom(ctx, id)
+	}
+	if room == nil {
+		http.Error(rw, msgNotFound, http.StatusNotFound)
+		return
+	}
+
+	m := forwardedMove{res: make(chan bool, 1), playerId: p.Id, index: index}
+	timeout := time.After(forwardWait)
+	select {
+	case room.moves <- m:
+	case <-timeout:
+		// The room might have been destroyed after the search.
+		http.Error(rw, msgBusy, http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case ok := <-m.res:
+		if !ok {
+			http.Error(rw, msgRejected, http.StatusConflict)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	case <-timeout:
+		http.Error(rw, msgBusy, http.StatusServiceUnavailable)
+	}
+}
+
+// AdjudicateCorrespondence periodically terminates correspondence games in which
+// the active player has missed the deadline.  Games are adjudicated by their
+// rooms, which are created for the games which aren't open.  Returns when the
+// context is canceled.
+func (s Service) AdjudicateCorrespondence(ctx context.Context) {
+	ticker := time.NewTicker(adjudicationTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := s.gameRepo.SelectExpiredCorrespondence()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		for _, id := range ids {
+			// The room adjudicates the game on the next tick and is destroyed
+			// once it stays empty.
+			if s.findRoom(id) == nil {
+				s.loadCorrespondenceRoom(ctx, id)
+			}
+		}
+	}
+}
+
+func (s Service) createRoom(ctx context.Context, p createRoomPayload) {
+	// The room of the correspondence game might be created concurrently.
+	if _, exists := s.rooms[p.id]; exists {
+		p.res <- struct{}{}
+		return
+	}
+
 	log.Printf("room %s created", p.id)
-	r := newRoom(p.game)
-	go r.listenEvents(p.id, s.remove)
+	r := newRoom(p.id, p.game, s.gameRepo)
+	r.configureSpectators(s.spectators)
+	r.playerRepo, r.create = s.playerRepo, s.create
+	r.checkpoints = s.checkpoints
+	if p.isRestored {
+		r.timeToLive = restoredDeadline
+	}
+	s.wg.Go(func() { r.listenEvents(ctx, s.remove) })
 	s.rooms[p.id] = r
 	p.res <- struct{}{}
 }
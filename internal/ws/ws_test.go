@@ -0,0 +1,177 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"justchess/internal/db"
+	"justchess/internal/event"
+	"justchess/internal/game"
+
+	"github.com/treepeck/chego"
+)
+
+// stubRepo implements [db.GameRepo] without checkpoints.  Other methods must
+// not be called.
+type stubRepo struct{ db.GameRepo }
+
+func (stubRepo) SelectCheckpoints() ([]db.Checkpoint, error) { return nil, nil }
+
+// stubGame implements [game.Game] and does nothing.
+type stubGame struct{}
+
+func (stubGame) Play(string, byte, int) (game.MovePayload, bool) {
+	return game.MovePayload{}, false
+}
+func (stubGame) Join(string)                   {}
+func (stubGame) Leave(string)                  {}
+func (stubGame) IsPlayer(id string) bool       { return id != "spectator" }
+func (stubGame) TimeTick()                     {}
+func (stubGame) Resign(string) bool            { return false }
+func (stubGame) GamePayload() game.GamePayload { return game.GamePayload{} }
+func (stubGame) EndPayload() game.EndPayload   { return game.EndPayload{} }
+func (stubGame) Abandon()                      {}
+
+func TestShutdown(t *testing.T) {
+	s := NewService(stubRepo{}, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenEvents(ctx)
+		close(stopped)
+	}()
+
+	if !requestRoom(ctx, s.create, createRoomPayload{
+		id: "room", game: stubGame{}, res: make(chan struct{}, 1),
+	}) {
+		t.Fatal("room is not created")
+	}
+	r := s.findRoom("room")
+	if r == nil {
+		t.Fatal("room is not found")
+	}
+	c := &client{player: db.Player{Id: "player"}, send: make(chan []byte, 192)}
+	r.register <- c
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("service is not stopped")
+	}
+
+	if !s.isClosed() || s.findRoom("room") != nil {
+		t.Fatal("service accepts requests after shutdown")
+	}
+
+	// The last event must notify the client about the maintenance.  Then the
+	// connection is closed.
+	var last event.Event
+	for len(c.send) > 1 {
+		if err := json.Unmarshal(<-c.send, &last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var msg string
+	if err := json.Unmarshal(last.Payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if last.Kind != event.Error || msg != msgShutdown {
+		t.Fatalf("expected: %s, got: %s", msgShutdown, msg)
+	}
+	if raw := <-c.send; raw != nil {
+		t.Fatalf("expected: connection close, got: %s", raw)
+	}
+}
+
+func TestEngineRequest(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected engineRequest
+		isValid  bool
+	}{
+		// Body of the clients which don't support custom positions.
+		{`3`, engineRequest{Difficulty: db.Hard}, true},
+		{`{"d":2}`, engineRequest{Difficulty: db.Medium}, true},
+		{`{"d":1,"f":"fen"}`, engineRequest{Difficulty: db.Easy, FEN: "fen"}, true},
+		{`"3"`, engineRequest{}, false},
+	}
+
+	for i, tc := range cases {
+		var got engineRequest
+		err := json.Unmarshal([]byte(tc.body), &got)
+		if (err == nil) != tc.isValid {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		if tc.isValid && got != tc.expected {
+			t.Fatalf("case %d: expected: %+v, got: %+v", i, tc.expected, got)
+		}
+	}
+}
+
+// acceptingGame is the stub game which accepts moves of the white player.
+type acceptingGame struct{ stubGame }
+
+func (acceptingGame) Play(id string, _ byte, _ int) (game.MovePayload, bool) {
+	return game.MovePayload{}, id == "white"
+}
+
+func TestForwardedMove(t *testing.T) {
+	cases := []struct {
+		playerId string
+		expected bool
+	}{
+		{"white", true},
+		{"black", false},
+	}
+
+	for i, tc := range cases {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := newRoom("room", acceptingGame{}, stubRepo{})
+		go r.listenEvents(ctx, make(chan string, 1))
+
+		m := forwardedMove{res: make(chan bool, 1), playerId: tc.playerId}
+		r.moves <- m
+		select {
+		case got := <-m.res:
+			if got != tc.expected {
+				t.Fatalf("case %d: expected: %v, got: %v", i, tc.expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("case %d: room doesn't reply", i)
+		}
+		cancel()
+	}
+}
+
+// terminatedRepo stores the checkpoint of the terminated game.
+type terminatedRepo struct {
+	stubRepo
+	deleted map[string]bool
+}
+
+func (terminatedRepo) SelectCheckpoints() ([]db.Checkpoint, error) {
+	return []db.Checkpoint{{Id: "room", Kind: db.RatedKind, UpdatedAt: time.Now()}}, nil
+}
+
+func (terminatedRepo) SelectTermination(db.Checkpoint) (chego.Termination, error) {
+	return chego.Resignation, nil
+}
+
+func (r terminatedRepo) DeleteCheckpoint(id string) error {
+	r.deleted[id] = true
+	return nil
+}
+
+func TestRestoreTerminated(t *testing.T) {
+	repo := terminatedRepo{deleted: make(map[string]bool)}
+	s := NewService(repo, nil, nil)
+	s.restoreRooms(context.Background())
+
+	if len(s.rooms) != 0 || !repo.deleted["room"] {
+		t.Fatal("checkpoint of the terminated game is restored")
+	}
+}